@@ -2,8 +2,11 @@ package rtmp
 
 import "bytes"
 import "encoding/binary"
-import "math"
 import "fmt"
+import "math"
+import "sort"
+import "reflect"
+import "unsafe"
 
 const (
 	AMF0_NUMBER       = 0X00
@@ -23,12 +26,30 @@ const (
 	AMF0_RECORDSET    = 0X0E
 	AMF0_XML_DOCUMENT = 0X0F
 	AMF0_TYPED_OBJECT = 0X10
+
+	// AMF0_AVMPLUS_OBJECT switches to AMF3 for the value that follows.
+	AMF0_AVMPLUS_OBJECT = 0X11
 )
 
 type Amf0 struct {
-	offset  int
-	buf     bytes.Buffer
-	aryData []byte
+	amfReader
+	buf bytes.Buffer
+
+	// The index of the objects and arrays written so far, by the identity
+	// of their map or list and -1 past what a reference can hold, those
+	// still being written, innermost last, and how many have been begun.
+	useRefs    bool
+	writeRefs  map[amfIdentity]int
+	writing    map[amfIdentity]bool
+	writeStack []amfWriteFrame
+	writeCount int
+}
+
+// amfWriteFrame is an object or array being written: the index ReadData
+// gave it, found in its RefIndex, and the one it takes in the output.
+type amfWriteFrame struct {
+	readIndex uint16
+	refIndex  int
 }
 
 const (
@@ -36,6 +57,19 @@ const (
 	AMF_DATA_OBJECT = 0XF1
 )
 
+// AMF_MAX_DEPTH is how deep objects and arrays may nest in decoded data.
+const AMF_MAX_DEPTH = 64
+
+// AmfData holds one decoded value, DataType telling which fields are set.
+// Objects come as AMF_DATA_OBJECT with ObjMap, ECMA arrays as
+// AMF0_ECMA_ARRAY with ObjMap, typed objects as AMF0_TYPED_OBJECT adding
+// ClassName, strict arrays come with ObjList, long strings and XML
+// documents with StrVal, and dates with DateVal in milliseconds since the
+// epoch plus the reserved TimeZone field. References are resolved to the
+// value they point to, sharing its ObjMap or ObjList; only a reference to an
+// object that encloses it is left as AMF0_REFERENCE with RefIndex, which
+// matches the RefIndex ReadData sets on every object and array to its place
+// in the reference table. Values sent as AMF3 come as described for Amf3.
 type AmfData struct {
 	DataType  byte
 	NumberVal float64
@@ -43,156 +77,164 @@ type AmfData struct {
 	BoolVal   byte
 	ObjMap    map[string]AmfData
 	ObjList   []AmfData
+	ClassName string
+	DateVal   float64
+	TimeZone  int16
+	RefIndex  uint16
+	BytesVal  []byte
 }
 
-func (a *Amf0) ReadData(aryData []byte, isProperty bool) AmfData {
+// ReadData decodes aryData into an AMF_DATA_ARRAY holding each of its values
+// in order. With isProperty set it instead reads the single value at the
+// current offset of the payload being decoded. Malformed or truncated input
+// yields an *AmfDecodeError along with the values read before it.
+func (a *Amf0) ReadData(aryData []byte, isProperty bool) (AmfData, error) {
 
-	var amfDataObj AmfData
+	if isProperty {
+		return a.readValue()
+	}
 
-	if !isProperty {
-		a.offset = 0
-		a.aryData = aryData
+	a.reset(aryData)
 
-	} else {
+	return a.readAll(a.readValue)
+}
 
+func (a *Amf0) readValue() (AmfData, error) {
+	if err := a.need(1, "value marker"); err != nil {
+		return AmfData{}, err
 	}
 
-	if a.offset == 0 {
-		amfDataObj.DataType = AMF_DATA_ARRAY
+	dataType := a.aryData[a.offset]
+
+	switch dataType {
+	case AMF0_NUMBER:
+		return a.readNumber()
+	case AMF0_BOOLEAN:
+		return a.readBoolean()
+	case AMF0_STRING:
+		return a.readString()
+	case AMF0_OBJECT:
+		return a.readObjectBegin()
+	case AMF0_NULL:
+		return a.readNull(), nil
+	case AMF0_UNDEFINED:
+		return a.readUndefined(), nil
+	case AMF0_REFERENCE:
+		return a.readReference()
+	case AMF0_ECMA_ARRAY:
+		return a.readEcmaArray()
+	case AMF0_OBJECT_END:
+		a.readObjectEnd()
+		return AmfData{DataType: AMF0_OBJECT_END}, nil
+	case AMF0_STRICT_ARRAY:
+		return a.readStrictArray()
+	case AMF0_DATE:
+		return a.readDate()
+	case AMF0_LONG_STRING, AMF0_XML_DOCUMENT:
+		return a.readLongString(dataType)
+	case AMF0_UNSUPPORTED:
+		return a.readUnsupported(), nil
+	case AMF0_TYPED_OBJECT:
+		return a.readTypedObject()
+	case AMF0_AVMPLUS_OBJECT:
+		return a.readAvmplusObject()
 	}
 
-	for {
-
-		if a.offset >= len(aryData) {
-			break
-		}
-
-		dataType := aryData[a.offset]
-
-		if dataType > 0x10 {
-			fmt.Printf("Data type error! this=%p dataType=%d isproperty=%t offset=%d ary=%v", a, dataType, isProperty, a.offset, aryData)
-			break
-		}
-
-		var amfDataObjRet AmfData
-
-		switch dataType {
-		case AMF0_NUMBER:
-			amfDataObjRet = a.readNumber()
-		case AMF0_BOOLEAN:
-			amfDataObjRet = a.readBoolean()
-		case AMF0_STRING:
-			var ret bool
-			amfDataObjRet, ret = a.readString()
-			if !ret {
-				break
-			}
-		case AMF0_OBJECT:
-			amfDataObjRet = a.readObjectBegin()
-		case AMF0_MOVIECLIP:
-			//amf0-file-format-specification
-			//The Movieclip and Recordset types are not supported for serialization;
-			//their markers are retained with a reserved status for future use
-			break
-		case AMF0_NULL:
-			amfDataObjRet = a.readNull()
-		case AMF0_UNDEFINED:
-			amfDataObjRet = a.readUndefined()
-		case AMF0_REFERENCE:
-			amfDataObjRet = a.readReference()
-		case AMF0_ECMA_ARRAY:
-			amfDataObjRet = a.readEcmaArray()
-		case AMF0_OBJECT_END:
-			a.readObjectEnd()
-			break
-		case AMF0_STRICT_ARRAY:
-			break
-		case AMF0_DATE:
-			break
-		case AMF0_LONG_STRING:
-			break
-		case AMF0_UNSUPPORTED:
-			break
-		case AMF0_RECORDSET:
-			break
-		case AMF0_XML_DOCUMENT:
-			break
-		case AMF0_TYPED_OBJECT:
-			break
-		default:
-			break
-
-		}
+	//amf0-file-format-specification
+	//The Movieclip and Recordset types are not supported for serialization;
+	//their markers are retained with a reserved status for future use
+	return AmfData{}, a.errorf("unsupported marker 0x%02X", dataType)
+}
 
-		if isProperty {
-			return amfDataObjRet
-		}
+func (a *Amf0) readNumber() (AmfData, error) {
+	var amfData AmfData
 
-		amfDataObj.ObjList = append(amfDataObj.ObjList, amfDataObjRet)
+	if err := a.need(9, "number"); err != nil {
+		return amfData, err
 	}
 
-	return amfDataObj
-}
-
-func (a *Amf0) readNumber() AmfData {
-	tempBuf := bytes.NewBuffer(a.aryData[a.offset+1 : a.offset+9])
-	var retVal float64
-
-	binary.Read(tempBuf, binary.BigEndian, &retVal)
+	retVal := math.Float64frombits(binary.BigEndian.Uint64(a.aryData[a.offset+1 : a.offset+9]))
 
 	a.offset += 9
 
-	var amfData AmfData
 	amfData.DataType = AMF0_NUMBER
 	amfData.NumberVal = retVal
 
-	return amfData
+	return amfData, nil
 }
 
-func (a *Amf0) readBoolean() AmfData {
+func (a *Amf0) readBoolean() (AmfData, error) {
+	var amfDataRet AmfData
+
+	if err := a.need(2, "boolean"); err != nil {
+		return amfDataRet, err
+	}
+
 	var boolVal byte = a.aryData[a.offset+1]
 
 	a.offset += 2
 
-	var amfDataRet AmfData
 	amfDataRet.DataType = AMF0_BOOLEAN
 	amfDataRet.BoolVal = boolVal
 
-	return amfDataRet
+	return amfDataRet, nil
 }
 
-func (a *Amf0) readString() (AmfData, bool) {
+func (a *Amf0) readString() (AmfData, error) {
 
 	var amfDataRet AmfData
 
-	tempBuf := bytes.NewBuffer(a.aryData[a.offset+1 : a.offset+3])
-	var strLen int16
+	if err := a.need(3, "string length"); err != nil {
+		return amfDataRet, err
+	}
 
-	binary.Read(tempBuf, binary.BigEndian, &strLen)
+	strLen := int(binary.BigEndian.Uint16(a.aryData[a.offset+1 : a.offset+3]))
 
-	if int(strLen) > (len(a.aryData) - a.offset) {
-		return amfDataRet, false
+	if err := a.need(3+strLen, "string"); err != nil {
+		return amfDataRet, err
 	}
 
-	strAry := a.aryData[a.offset+3 : a.offset+3+int(strLen)]
+	strAry := a.aryData[a.offset+3 : a.offset+3+strLen]
 
-	a.offset = a.offset + 3 + int(strLen)
+	a.offset = a.offset + 3 + strLen
 
 	amfDataRet.DataType = AMF0_STRING
 	amfDataRet.StrVal = string(strAry)
 
-	return amfDataRet, true
+	return amfDataRet, nil
 }
 
-func (a *Amf0) readObjectBegin() AmfData {
+func (a *Amf0) readObjectBegin() (AmfData, error) {
 	a.offset += 1
 
+	refIndex := a.addReadRef()
+
 	var amfDataRet AmfData
 	amfDataRet.DataType = AMF_DATA_OBJECT
 
-	amfDataRet.ObjMap = a.readObject()
+	objMap, err := a.readObject(false)
+	amfDataRet.ObjMap = objMap
+	if err != nil {
+		return amfDataRet, err
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
 
-	return amfDataRet
+	return amfDataRet, nil
+}
+
+// readAvmplusObject reads the AMF3 value that follows the switch marker,
+// with reference tables of its own.
+func (a *Amf0) readAvmplusObject() (AmfData, error) {
+	var amf3 Amf3
+	amf3.aryData = a.aryData
+	amf3.offset = a.offset + 1
+	amf3.depth = a.depth
+
+	amfData, err := amf3.readValue()
+	a.offset = amf3.offset
+
+	return amfData, err
 }
 
 func (a *Amf0) readObjectEnd() {
@@ -218,81 +260,276 @@ func (a *Amf0) readUndefined() AmfData {
 
 }
 
-func (a *Amf0) readReference() AmfData {
-	tempBuf := bytes.NewBuffer(a.aryData[a.offset+1 : a.offset+3])
-	var refLen int16
+func (a *Amf0) readReference() (AmfData, error) {
+	var amfData AmfData
 
-	binary.Read(tempBuf, binary.BigEndian, &refLen)
+	if err := a.need(3, "reference"); err != nil {
+		return amfData, err
+	}
+
+	refIndex := binary.BigEndian.Uint16(a.aryData[a.offset+1 : a.offset+3])
+
+	if int(refIndex) >= len(a.readRefs) {
+		return amfData, a.errorf("reference %d to one of %d objects", refIndex, len(a.readRefs))
+	}
 
 	a.offset += 3
 
-	var amfData AmfData
+	if a.readRefDone[refIndex] {
+		return a.readRefs[refIndex], nil
+	}
+
 	amfData.DataType = AMF0_REFERENCE
+	amfData.RefIndex = refIndex
 
-	return amfData
+	return amfData, nil
 }
 
-func (a *Amf0) readEcmaArray() AmfData {
+func (a *Amf0) readEcmaArray() (AmfData, error) {
 
-	tempBuf := bytes.NewBuffer(a.aryData[a.offset+1 : a.offset+5])
-	var aryLen uint32
+	var amfDataRet AmfData
 
-	binary.Read(tempBuf, binary.BigEndian, &aryLen)
+	// The count is only a hint; the properties end like an object's.
+	if err := a.need(5, "ECMA array count"); err != nil {
+		return amfDataRet, err
+	}
 
 	a.offset += 5
 
+	refIndex := a.addReadRef()
+
+	amfDataRet.DataType = AMF0_ECMA_ARRAY
+
+	objMap, err := a.readObject(true)
+	amfDataRet.ObjMap = objMap
+	if err != nil {
+		return amfDataRet, err
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf0) readStrictArray() (AmfData, error) {
 	var amfDataRet AmfData
-	amfDataRet.DataType = AMF_DATA_OBJECT
 
-	/*
-		for i := 0; i < int(aryLen); i++ {
-			key, amfData := a.readObject()
-			amfData.ObjMap[key] = amfData
+	if err := a.need(5, "strict array count"); err != nil {
+		return amfDataRet, err
+	}
+
+	aryLen := binary.BigEndian.Uint32(a.aryData[a.offset+1 : a.offset+5])
+
+	// Every value takes at least its marker byte.
+	if uint64(aryLen) > uint64(len(a.aryData)-a.offset-5) {
+		return amfDataRet, a.errorf("strict array of %d values in %d bytes", aryLen, len(a.aryData)-a.offset-5)
+	}
+
+	if err := a.enter(); err != nil {
+		return amfDataRet, err
+	}
+	defer a.leave()
+
+	a.offset += 5
+
+	refIndex := a.addReadRef()
+
+	amfDataRet.DataType = AMF0_STRICT_ARRAY
+	amfDataRet.ObjList = make([]AmfData, 0, amfListCap(aryLen))
+
+	for i := 0; i < int(aryLen); i++ {
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
 		}
-	*/
+		amfDataRet.ObjList = append(amfDataRet.ObjList, amfData)
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+// amfListCap is the room made up front for a list the peer says holds count
+// values. Every value takes a byte or more, but a list takes far more memory
+// than that, and lists nested in one another could otherwise each claim the
+// rest of the payload.
+func amfListCap(count uint32) int {
+	if count > 1024 {
+		return 1024
+	}
+
+	return int(count)
+}
+
+func (a *Amf0) readDate() (AmfData, error) {
+	var amfDataRet AmfData
+
+	if err := a.need(11, "date"); err != nil {
+		return amfDataRet, err
+	}
+
+	amfDataRet.DataType = AMF0_DATE
+	amfDataRet.DateVal = math.Float64frombits(binary.BigEndian.Uint64(a.aryData[a.offset+1 : a.offset+9]))
+	amfDataRet.TimeZone = int16(binary.BigEndian.Uint16(a.aryData[a.offset+9 : a.offset+11]))
+
+	a.offset += 11
+
+	return amfDataRet, nil
+}
+
+// readLongString reads a long string or an XML document, which share the
+// 32-bit length prefix.
+func (a *Amf0) readLongString(dataType byte) (AmfData, error) {
+
+	var amfDataRet AmfData
+
+	if err := a.need(5, "long string length"); err != nil {
+		return amfDataRet, err
+	}
+
+	strLen := binary.BigEndian.Uint32(a.aryData[a.offset+1 : a.offset+5])
+
+	if uint64(strLen) > uint64(len(a.aryData)-a.offset-5) {
+		return amfDataRet, a.errorf("long string of %d bytes, %d left", strLen, len(a.aryData)-a.offset-5)
+	}
+
+	strAry := a.aryData[a.offset+5 : a.offset+5+int(strLen)]
+
+	a.offset = a.offset + 5 + int(strLen)
+
+	amfDataRet.DataType = dataType
+	amfDataRet.StrVal = string(strAry)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf0) readUnsupported() AmfData {
+	a.offset += 1
+
+	var amfData AmfData
+	amfData.DataType = AMF0_UNSUPPORTED
+
+	return amfData
+}
+
+func (a *Amf0) readTypedObject() (AmfData, error) {
+	a.offset += 1
+
+	refIndex := a.addReadRef()
 
-	amfDataRet.ObjMap = a.readObject()
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF0_TYPED_OBJECT
+
+	_, className, err := a.readPropertyKey()
+	if err != nil {
+		return amfDataRet, err
+	}
+	amfDataRet.ClassName = className
 
-	return amfDataRet
+	objMap, err := a.readObject(false)
+	amfDataRet.ObjMap = objMap
+	if err != nil {
+		return amfDataRet, err
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
 }
 
-func (a *Amf0) readObject() map[string]AmfData {
+// readObject reads properties up to the empty key and object end marker.
+// Some encoders leave the end out of an ECMA array that closes the payload,
+// which is accepted when ecmaArray is set.
+func (a *Amf0) readObject(ecmaArray bool) (map[string]AmfData, error) {
 
 	var mapAmfDataTemp = make(map[string]AmfData)
 
+	if err := a.enter(); err != nil {
+		return mapAmfDataTemp, err
+	}
+	defer a.leave()
+
 	for {
-		len, key := a.readPropertyKey()
+		if ecmaArray && a.offset == len(a.aryData) {
+			return mapAmfDataTemp, nil
+		}
+
+		len, key, err := a.readPropertyKey()
+		if err != nil {
+			return mapAmfDataTemp, err
+		}
+
 		if len == 0 {
-			a.offset += 1
-			return mapAmfDataTemp
+			if err := a.need(1, "object end"); err != nil {
+				return mapAmfDataTemp, err
+			}
+			if a.aryData[a.offset] == AMF0_OBJECT_END {
+				a.offset += 1
+				return mapAmfDataTemp, nil
+			}
 		}
 
-		amfData := a.ReadData(a.aryData, true)
+		if err := a.need(1, "property value"); err != nil {
+			return mapAmfDataTemp, err
+		}
+		if a.aryData[a.offset] == AMF0_OBJECT_END {
+			return mapAmfDataTemp, a.errorf("object end marker as the value of %q", key)
+		}
+
+		amfData, err := a.readValue()
+		if err != nil {
+			return mapAmfDataTemp, err
+		}
 
 		mapAmfDataTemp[key] = amfData
 
 	}
-
-	return mapAmfDataTemp
 }
 
-func (a *Amf0) readPropertyKey() (uint16, string) {
+func (a *Amf0) readPropertyKey() (uint16, string, error) {
+
+	if err := a.need(2, "property name length"); err != nil {
+		return 0, "", err
+	}
 
-	tempBuf := bytes.NewBuffer(a.aryData[a.offset : a.offset+2])
-	var keyLen uint16
+	keyLen := binary.BigEndian.Uint16(a.aryData[a.offset : a.offset+2])
 
-	binary.Read(tempBuf, binary.BigEndian, &keyLen)
+	if err := a.need(2+int(keyLen), "property name"); err != nil {
+		return 0, "", err
+	}
 
 	key := a.aryData[a.offset+2 : a.offset+2+int(keyLen)]
 
 	a.offset = a.offset + 2 + int(keyLen)
 
-	return keyLen, string(key)
+	return keyLen, string(key), nil
 
 }
 
 func (a *Amf0) InitWrite() {
 	a.offset = 0
+	a.writeRefs = nil
+	a.writing = nil
+	a.writeStack = nil
+	a.writeCount = 0
+}
+
+// SetUseReferences makes WriteData write an object or array it has already
+// written in the message as a reference to it, telling them apart by the
+// identity of their ObjMap or ObjList. An object that contains itself is
+// always written with a reference, which is the only way AMF0 can express
+// it.
+func (a *Amf0) SetUseReferences(useRefs bool) {
+	a.useRefs = useRefs
+}
+
+func (a *Amf0) WriteReference(refIndex uint16) {
+	tempAry := make([]byte, 2)
+	binary.BigEndian.PutUint16(tempAry, refIndex)
+
+	a.buf.WriteByte(AMF0_REFERENCE)
+	a.buf.Write(tempAry)
 }
 
 func (a *Amf0) WriteNull() {
@@ -312,6 +549,12 @@ func (a *Amf0) WriteString(strVal string) {
 	strLen := len(strVal)
 	tempAry := make([]byte, 2)
 
+	// Too long for the 16-bit length of a plain string.
+	if strLen > 0xFFFF {
+		a.WriteLongString(strVal)
+		return
+	}
+
 	binary.BigEndian.PutUint16(tempAry, uint16(strLen))
 
 	a.buf.WriteByte(0x02)
@@ -321,6 +564,7 @@ func (a *Amf0) WriteString(strVal string) {
 }
 
 func (a *Amf0) WriteObjectBegin() {
+	a.writeCount++
 	a.buf.WriteByte(0x03)
 }
 
@@ -354,6 +598,7 @@ func (a *Amf0) WriteEcmaAryBegin(aryCount uint32) {
 	tempAry := make([]byte, 4)
 	binary.BigEndian.PutUint32(tempAry, aryCount)
 
+	a.writeCount++
 	a.buf.WriteByte(0x08)
 	a.buf.Write(tempAry)
 }
@@ -362,22 +607,279 @@ func (a *Amf0) WriteStrictAryBegin(aryCount uint32) {
 	tempAry := make([]byte, 4)
 	binary.BigEndian.PutUint32(tempAry, aryCount)
 
+	a.writeCount++
 	a.buf.WriteByte(0x0A)
 	a.buf.Write(tempAry)
 }
 
+func (a *Amf0) WriteBoolean(boolVal bool) {
+	a.buf.WriteByte(AMF0_BOOLEAN)
+	if boolVal {
+		a.buf.WriteByte(0x01)
+	} else {
+		a.buf.WriteByte(0x00)
+	}
+}
+
+func (a *Amf0) WriteUndefined() {
+	a.buf.WriteByte(AMF0_UNDEFINED)
+}
+
+func (a *Amf0) WriteUnsupported() {
+	a.buf.WriteByte(AMF0_UNSUPPORTED)
+}
+
+// WriteLongString writes strVal with a 32-bit length, as needed for strings
+// longer than 65535 bytes.
+func (a *Amf0) WriteLongString(strVal string) {
+	a.writeLongString(AMF0_LONG_STRING, strVal)
+}
+
+func (a *Amf0) WriteXmlDocument(strVal string) {
+	a.writeLongString(AMF0_XML_DOCUMENT, strVal)
+}
+
+func (a *Amf0) writeLongString(dataType byte, strVal string) {
+	tempAry := make([]byte, 4)
+	binary.BigEndian.PutUint32(tempAry, uint32(len(strVal)))
+
+	a.buf.WriteByte(dataType)
+	a.buf.Write(tempAry)
+	a.buf.WriteString(strVal)
+}
+
+// WriteDate writes a date given in milliseconds since the epoch. timeZone
+// is reserved and should be 0.
+func (a *Amf0) WriteDate(dateVal float64, timeZone int16) {
+	tempAry := make([]byte, 10)
+	binary.BigEndian.PutUint64(tempAry, math.Float64bits(dateVal))
+	binary.BigEndian.PutUint16(tempAry[8:], uint16(timeZone))
+
+	a.buf.WriteByte(AMF0_DATE)
+	a.buf.Write(tempAry)
+}
+
+// WriteTypedObjectBegin starts an object of the named class. Properties and
+// WriteObjectEnd follow as for WriteObjectBegin.
+func (a *Amf0) WriteTypedObjectBegin(className string) {
+	a.writeCount++
+	a.buf.WriteByte(AMF0_TYPED_OBJECT)
+	a.WritePropertyKey(className)
+}
+
+// WriteData writes a value as returned by ReadData. Object properties are
+// written in key order. Values only AMF3 can express, including arrays with
+// named elements, are written with WriteAmf3. An AMF_DATA_ARRAY writes its
+// values one after the other, the way ReadData found them. An
+// AMF0_REFERENCE that ReadData left unresolved is written as a reference to
+// the enclosing value it pointed to, at the index that value takes here.
+//
+// Values the output can not hold as they are fail with an error wrapping
+// ErrAMFEncode, leaving the output incomplete: a value AMF3 can not express,
+// a reference to no enclosing value, one needed past the last index a
+// reference can hold, and repeated values taking the output past
+// amfMaxCopiedSize bytes while references are not wanted.
+func (a *Amf0) WriteData(amfData AmfData) error {
+	switch amfData.DataType {
+	case AMF0_NUMBER:
+		a.WriteNumber(amfData.NumberVal)
+	case AMF0_BOOLEAN:
+		a.WriteBoolean(amfData.BoolVal != 0)
+	case AMF0_STRING:
+		a.WriteString(amfData.StrVal)
+	case AMF0_LONG_STRING:
+		a.WriteLongString(amfData.StrVal)
+	case AMF0_XML_DOCUMENT:
+		a.WriteXmlDocument(amfData.StrVal)
+	case AMF0_NULL:
+		a.WriteNull()
+	case AMF0_UNDEFINED:
+		a.WriteUndefined()
+	case AMF0_UNSUPPORTED:
+		a.WriteUnsupported()
+	case AMF0_DATE:
+		a.WriteDate(amfData.DateVal, amfData.TimeZone)
+	case AMF0_REFERENCE:
+		return a.writeEnclosingReference(amfData.RefIndex)
+	case AMF0_STRICT_ARRAY:
+		if len(amfData.ObjMap) > 0 {
+			return a.WriteAmf3(amfData)
+		}
+		return a.writeComplex(amfData)
+	case AMF_DATA_OBJECT, AMF0_OBJECT, AMF0_ECMA_ARRAY, AMF0_TYPED_OBJECT:
+		return a.writeComplex(amfData)
+	case AMF_DATA_XML, AMF_DATA_BYTE_ARRAY, AMF_DATA_VECTOR_INT, AMF_DATA_VECTOR_UINT,
+		AMF_DATA_VECTOR_DOUBLE, AMF_DATA_VECTOR_OBJECT, AMF_DATA_DICTIONARY:
+		return a.WriteAmf3(amfData)
+	case AMF_DATA_ARRAY:
+		return a.writeList(amfData.ObjList)
+	}
+
+	return nil
+}
+
+// WriteAmf3 writes the switch marker and amfData encoded as AMF3, with
+// reference tables of its own. If AMF3 can not express amfData, nothing is
+// written and the error from Amf3.WriteData is returned.
+func (a *Amf0) WriteAmf3(amfData AmfData) error {
+	var amf3 Amf3
+	if err := amf3.WriteData(amfData); err != nil {
+		return err
+	}
+
+	a.buf.WriteByte(AMF0_AVMPLUS_OBJECT)
+	a.buf.Write(amf3.GetData())
+
+	return nil
+}
+
+// amfMaxCopiedSize is how large the output may grow while WriteData writes
+// repeated objects and arrays out in full because references are not
+// wanted. Shared values nested in one another would otherwise double the
+// output at every level.
+const amfMaxCopiedSize = 1 << 20
+
+// writeComplex writes an object or array, or a reference to it if it was
+// written before and references are wanted, or if it is being written.
+func (a *Amf0) writeComplex(amfData AmfData) error {
+	id := amfDataIdentity(amfData)
+
+	if id.p != nil {
+		if refIndex, ok := a.writeRefs[id]; ok {
+			if a.useRefs || a.writing[id] {
+				return a.writeRefIndex(refIndex)
+			}
+			if a.buf.Len() >= amfMaxCopiedSize {
+				return fmt.Errorf("%w: repeated values past %d bytes without references", ErrAMFEncode, amfMaxCopiedSize)
+			}
+		}
+	}
+
+	// The Begin call below takes the next index.
+	refIndex := a.writeCount
+	if refIndex > 0xFFFF {
+		refIndex = -1
+	}
+
+	if id.p != nil {
+		if a.writeRefs == nil {
+			a.writeRefs = make(map[amfIdentity]int)
+			a.writing = make(map[amfIdentity]bool)
+		}
+		if _, ok := a.writeRefs[id]; !ok {
+			a.writeRefs[id] = refIndex
+		}
+		a.writing[id] = true
+		defer delete(a.writing, id)
+	}
+
+	a.writeStack = append(a.writeStack, amfWriteFrame{readIndex: amfData.RefIndex, refIndex: refIndex})
+	defer func() { a.writeStack = a.writeStack[:len(a.writeStack)-1] }()
+
+	switch amfData.DataType {
+	case AMF0_ECMA_ARRAY:
+		a.WriteEcmaAryBegin(uint32(len(amfData.ObjMap)))
+		return a.writeProperties(amfData.ObjMap)
+	case AMF0_TYPED_OBJECT:
+		a.WriteTypedObjectBegin(amfData.ClassName)
+		return a.writeProperties(amfData.ObjMap)
+	case AMF0_STRICT_ARRAY:
+		a.WriteStrictAryBegin(uint32(len(amfData.ObjList)))
+		return a.writeList(amfData.ObjList)
+	default:
+		a.WriteObjectBegin()
+		return a.writeProperties(amfData.ObjMap)
+	}
+}
+
+// writeEnclosingReference writes a reference to the innermost value being
+// written that ReadData gave readIndex.
+func (a *Amf0) writeEnclosingReference(readIndex uint16) error {
+	for i := len(a.writeStack) - 1; i >= 0; i-- {
+		if a.writeStack[i].readIndex == readIndex {
+			return a.writeRefIndex(a.writeStack[i].refIndex)
+		}
+	}
+
+	return fmt.Errorf("%w: reference %d to no enclosing value", ErrAMFEncode, readIndex)
+}
+
+func (a *Amf0) writeRefIndex(refIndex int) error {
+	if refIndex < 0 {
+		return fmt.Errorf("%w: reference past index %d", ErrAMFEncode, 0xFFFF)
+	}
+
+	a.WriteReference(uint16(refIndex))
+
+	return nil
+}
+
+// amfIdentity tells one object, array or byte array apart from an equal
+// copy: the map, or the start and length of the list or bytes, as two
+// slices of one backing array hold different values.
+type amfIdentity struct {
+	p unsafe.Pointer
+	n int
+}
+
+// amfDataIdentity returns the identity of an object or array. Empty values
+// have none.
+func amfDataIdentity(amfData AmfData) amfIdentity {
+	if amfData.DataType == AMF0_STRICT_ARRAY {
+		if len(amfData.ObjList) == 0 {
+			return amfIdentity{}
+		}
+		return amfIdentity{unsafe.Pointer(unsafe.SliceData(amfData.ObjList)), len(amfData.ObjList)}
+	}
+
+	if amfData.ObjMap == nil {
+		return amfIdentity{}
+	}
+
+	return amfIdentity{p: reflect.ValueOf(amfData.ObjMap).UnsafePointer()}
+}
+
+func (a *Amf0) writeList(list []AmfData) error {
+	for _, item := range list {
+		if err := a.WriteData(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Amf0) writeProperties(objMap map[string]AmfData) error {
+	keys := make([]string, 0, len(objMap))
+	for key := range objMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		a.WritePropertyKey(key)
+		if err := a.WriteData(objMap[key]); err != nil {
+			return err
+		}
+	}
+
+	a.WriteObjectEnd()
+
+	return nil
+}
+
 func (a *Amf0) GetData() []byte {
 	return a.buf.Bytes()
 }
 
 func (a *Amf0) GetCommand(aryData []byte) string {
 
-	if aryData[0] != 0x02 {
+	if len(aryData) < 3 || aryData[0] != 0x02 {
 		return ""
 	}
 
 	tempBuf := bytes.NewBuffer(aryData[1:3])
-	var strLen int16
+	var strLen uint16
 
 	binary.Read(tempBuf, binary.BigEndian, &strLen)
 
@@ -0,0 +1,38 @@
+package rtmp
+
+import "errors"
+import "testing"
+
+// FuzzAmf0ReadData decodes arbitrary payloads, seeded from testdata with the
+// commands and metadata real clients send. Decoding must fail only with an
+// *AmfDecodeError, and what it decodes must either encode to a payload that
+// decodes again or be refused with ErrAMFEncode.
+func FuzzAmf0ReadData(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r Amf0
+		amfData, err := r.ReadData(data, false)
+		r.GetCommand(data)
+		if err != nil {
+			var decodeErr *AmfDecodeError
+			if !errors.As(err, &decodeErr) || !errors.Is(err, ErrAMFDecode) {
+				t.Fatalf("ReadData returned %v, want an *AmfDecodeError", err)
+			}
+			return
+		}
+
+		var w Amf0
+		for _, item := range amfData.ObjList {
+			if err := w.WriteData(item); err != nil {
+				if !errors.Is(err, ErrAMFEncode) {
+					t.Fatalf("WriteData returned %v, want ErrAMFEncode", err)
+				}
+				return
+			}
+		}
+
+		var r2 Amf0
+		if _, err := r2.ReadData(w.GetData(), false); err != nil {
+			t.Fatalf("decoding the re-encoded payload: %v", err)
+		}
+	})
+}
@@ -0,0 +1,578 @@
+package rtmp
+
+import "fmt"
+import "math"
+import "reflect"
+import "sort"
+import "strings"
+import "time"
+
+// Amf0EcmaArray marshals as an ECMA array rather than an object, as
+// onMetaData expects.
+type Amf0EcmaArray map[string]interface{}
+
+var amfDataType = reflect.TypeOf(AmfData{})
+var timeType = reflect.TypeOf(time.Time{})
+var ecmaArrayType = reflect.TypeOf(Amf0EcmaArray{})
+var bytesType = reflect.TypeOf([]byte{})
+
+// Amf0Marshal encodes values one after the other, the way a command and its
+// arguments follow each other in a message.
+//
+// Booleans, numbers and strings map to their AMF0 counterparts, time.Time to
+// a Date, slices and arrays to strict arrays, and structs and maps with
+// string keys to objects. Struct fields are written in order under the name
+// given by an `amf:"name"` tag or their own; ",omitempty" leaves out zero
+// values and "-" the field. Nil pointers, maps, slices and interfaces are
+// written as null, and AmfData values as they are.
+func Amf0Marshal(values ...interface{}) ([]byte, error) {
+	var e amf0Encoder
+	e.visiting = make(map[uintptr]bool)
+
+	for _, v := range values {
+		if err := e.encode(reflect.ValueOf(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.amf.GetData(), nil
+}
+
+// Amf0Unmarshal decodes the values in data into the pointers in values, in
+// order. A nil pointer skips a value and values left over in data are
+// ignored. It is the reverse of Amf0Marshal; into an empty interface,
+// objects decode as map[string]interface{}, ECMA arrays as Amf0EcmaArray,
+// strict arrays as []interface{}, numbers as float64 and Dates as
+// time.Time. AMF3 values behind AMF0_AVMPLUS_OBJECT decode the same way,
+// with vectors as lists and byte arrays as []byte.
+func Amf0Unmarshal(data []byte, values ...interface{}) error {
+	var amf Amf0
+	amfData, err := amf.ReadData(data, false)
+	if err != nil {
+		return err
+	}
+
+	var d amf0Decoder
+
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Pointer || rv.IsNil() {
+			return fmt.Errorf("%w: value %d is not a non-nil pointer", ErrAMFDecode, i)
+		}
+
+		if i >= len(amfData.ObjList) {
+			return fmt.Errorf("%w: %d values wanted, %d found", ErrAMFDecode, len(values), len(amfData.ObjList))
+		}
+
+		if err := d.assign(amfData.ObjList[i], rv.Elem()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type amf0Encoder struct {
+	amf      Amf0
+	visiting map[uintptr]bool
+}
+
+func (e *amf0Encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.amf.WriteNull()
+		return nil
+	}
+
+	switch v.Type() {
+	case amfDataType:
+		return e.amf.WriteData(v.Interface().(AmfData))
+	case timeType:
+		t := v.Interface().(time.Time)
+		e.amf.WriteDate(float64(t.UnixMilli()), 0)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		e.amf.WriteBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.amf.WriteNumber(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.amf.WriteNumber(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		e.amf.WriteNumber(v.Float())
+	case reflect.String:
+		e.amf.WriteString(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			e.amf.WriteNull()
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			e.amf.WriteNull()
+			return nil
+		}
+		if e.visiting[v.Pointer()] {
+			return fmt.Errorf("%w: cycle through %s", ErrAMFEncode, v.Type())
+		}
+		e.visiting[v.Pointer()] = true
+		defer delete(e.visiting, v.Pointer())
+		return e.encode(v.Elem())
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			e.amf.WriteNull()
+			return nil
+		}
+		if e.visiting[v.Pointer()] {
+			return fmt.Errorf("%w: cycle through %s", ErrAMFEncode, v.Type())
+		}
+		e.visiting[v.Pointer()] = true
+		defer delete(e.visiting, v.Pointer())
+		return e.encodeList(v)
+	case reflect.Array:
+		return e.encodeList(v)
+	default:
+		return fmt.Errorf("%w: unsupported type %s", ErrAMFEncode, v.Type())
+	}
+
+	return nil
+}
+
+func (e *amf0Encoder) encodeList(v reflect.Value) error {
+	e.amf.WriteStrictAryBegin(uint32(v.Len()))
+
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *amf0Encoder) encodeMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("%w: map key type %s is not a string", ErrAMFEncode, v.Type().Key())
+	}
+
+	if v.IsNil() {
+		e.amf.WriteNull()
+		return nil
+	}
+
+	if e.visiting[v.Pointer()] {
+		return fmt.Errorf("%w: cycle through %s", ErrAMFEncode, v.Type())
+	}
+	e.visiting[v.Pointer()] = true
+	defer delete(e.visiting, v.Pointer())
+
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	if v.Type() == ecmaArrayType {
+		e.amf.WriteEcmaAryBegin(uint32(len(keys)))
+	} else {
+		e.amf.WriteObjectBegin()
+	}
+
+	for _, key := range keys {
+		e.amf.WritePropertyKey(key)
+		if err := e.encode(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))); err != nil {
+			return err
+		}
+	}
+
+	e.amf.WriteObjectEnd()
+
+	return nil
+}
+
+func (e *amf0Encoder) encodeStruct(v reflect.Value) error {
+	e.amf.WriteObjectBegin()
+
+	for _, field := range amf0Fields(v.Type()) {
+		fv, ok := amf0FieldByIndex(v, field.index)
+		if !ok || (field.omitEmpty && fv.IsZero()) {
+			continue
+		}
+
+		e.amf.WritePropertyKey(field.name)
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+
+	e.amf.WriteObjectEnd()
+
+	return nil
+}
+
+type amf0Field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// amf0Fields lists the fields of a struct type that get marshaled, in order,
+// with those of embedded structs without a tag name in place of them.
+func amf0Fields(t reflect.Type) []amf0Field {
+	var fields []amf0Field
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag := sf.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		omitEmpty := opts == "omitempty"
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for _, inner := range amf0Fields(ft) {
+				inner.index = append([]int{i}, inner.index...)
+				fields = append(fields, inner)
+			}
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, amf0Field{name: name, index: []int{i}, omitEmpty: omitEmpty})
+	}
+
+	return fields
+}
+
+// amf0FieldByIndex is reflect.Value.FieldByIndex that reports a nil embedded
+// pointer on the way instead of panicking.
+func amf0FieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v, true
+}
+
+// amfMaxAssignedValues is how many values Amf0Unmarshal stores before it
+// gives up. An object referenced from several places is stored once for
+// each, so a short payload can otherwise expand without end.
+const amfMaxAssignedValues = 1 << 20
+
+// amf0Decoder holds the state of one Amf0Unmarshal call: how many values
+// it has stored, and what each object or array decoded into an empty
+// interface became, so that one shared in the payload is shared in the
+// result too and converted once.
+type amf0Decoder struct {
+	assigned int
+	naturals map[amfIdentity]interface{}
+}
+
+// assign stores a decoded value in v, converting it to v's type.
+func (d *amf0Decoder) assign(amfData AmfData, v reflect.Value) error {
+	d.assigned++
+	if d.assigned > amfMaxAssignedValues {
+		return fmt.Errorf("%w: more than %d values to store", ErrAMFDecode, amfMaxAssignedValues)
+	}
+
+	if v.Type() == amfDataType {
+		v.Set(reflect.ValueOf(amfData))
+		return nil
+	}
+
+	if amfData.DataType == AMF0_NULL || amfData.DataType == AMF0_UNDEFINED {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.assign(amfData, v.Elem())
+	}
+
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() > 0 {
+			return amf0TypeError(amfData, v.Type())
+		}
+		value, err := d.natural(amfData)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	if v.Type() == timeType {
+		if amfData.DataType != AMF0_DATE {
+			return amf0TypeError(amfData, v.Type())
+		}
+		v.Set(reflect.ValueOf(time.UnixMilli(int64(amfData.DateVal))))
+		return nil
+	}
+
+	switch amfData.DataType {
+	case AMF0_NUMBER:
+		return amf0AssignNumber(amfData.NumberVal, v)
+	case AMF0_BOOLEAN:
+		if v.Kind() != reflect.Bool {
+			return amf0TypeError(amfData, v.Type())
+		}
+		v.SetBool(amfData.BoolVal != 0)
+	case AMF0_STRING, AMF0_LONG_STRING, AMF0_XML_DOCUMENT, AMF_DATA_XML:
+		if v.Kind() != reflect.String {
+			return amf0TypeError(amfData, v.Type())
+		}
+		v.SetString(amfData.StrVal)
+	case AMF_DATA_OBJECT, AMF0_ECMA_ARRAY, AMF0_TYPED_OBJECT:
+		return d.assignObject(amfData, v)
+	case AMF_DATA_BYTE_ARRAY:
+		if v.Type() != bytesType {
+			return amf0TypeError(amfData, v.Type())
+		}
+		v.SetBytes(append([]byte{}, amfData.BytesVal...))
+	case AMF0_STRICT_ARRAY, AMF_DATA_VECTOR_INT, AMF_DATA_VECTOR_UINT, AMF_DATA_VECTOR_DOUBLE, AMF_DATA_VECTOR_OBJECT:
+		return d.assignList(amfData, v)
+	default:
+		return amf0TypeError(amfData, v.Type())
+	}
+
+	return nil
+}
+
+func amf0AssignNumber(number float64, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// Converting a float64 outside the range of int64 gives an
+		// undefined result, so the range is checked first.
+		if number != math.Trunc(number) || number >= 1<<63 || number < -(1<<63) || v.OverflowInt(int64(number)) {
+			return fmt.Errorf("%w: number %v does not fit %s", ErrAMFDecode, number, v.Type())
+		}
+		v.SetInt(int64(number))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if number != math.Trunc(number) || number < 0 || number >= 1<<64 || v.OverflowUint(uint64(number)) {
+			return fmt.Errorf("%w: number %v does not fit %s", ErrAMFDecode, number, v.Type())
+		}
+		v.SetUint(uint64(number))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(number)
+	default:
+		return fmt.Errorf("%w: can not put a number into %s", ErrAMFDecode, v.Type())
+	}
+
+	return nil
+}
+
+func (d *amf0Decoder) assignObject(amfData AmfData, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := amf0Fields(v.Type())
+		for key, item := range amfData.ObjMap {
+			field, ok := amf0FindField(fields, key)
+			if !ok {
+				continue
+			}
+			fv, ok := amf0FieldByIndexAlloc(v, field.index)
+			if !ok {
+				continue
+			}
+			if err := d.assign(item, fv); err != nil {
+				return fmt.Errorf("field %s: %w", key, err)
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return amf0TypeError(amfData, v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(amfData.ObjMap)))
+		}
+		for key, item := range amfData.ObjMap {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.assign(item, elem); err != nil {
+				return fmt.Errorf("key %s: %w", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	default:
+		return amf0TypeError(amfData, v.Type())
+	}
+
+	return nil
+}
+
+// amf0FindField finds the field for a key, preferring an exact match of
+// the name over one that differs in case only.
+func amf0FindField(fields []amf0Field, key string) (amf0Field, bool) {
+	for _, field := range fields {
+		if field.name == key {
+			return field, true
+		}
+	}
+
+	for _, field := range fields {
+		if strings.EqualFold(field.name, key) {
+			return field, true
+		}
+	}
+
+	return amf0Field{}, false
+}
+
+// amf0FieldByIndexAlloc is reflect.Value.FieldByIndex that allocates nil
+// embedded pointers on the way, skipping those to unexported types.
+func amf0FieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v, true
+}
+
+func (d *amf0Decoder) assignList(amfData AmfData, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), len(amfData.ObjList), len(amfData.ObjList))
+		for i, item := range amfData.ObjList {
+			if err := d.assign(item, list.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+		v.Set(list)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(amfData.ObjList) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := d.assign(amfData.ObjList[i], v.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+	default:
+		return amf0TypeError(amfData, v.Type())
+	}
+
+	return nil
+}
+
+// natural converts a decoded value to the Go type an empty interface gets.
+func (d *amf0Decoder) natural(amfData AmfData) (interface{}, error) {
+	switch amfData.DataType {
+	case AMF0_NUMBER:
+		return amfData.NumberVal, nil
+	case AMF0_BOOLEAN:
+		return amfData.BoolVal != 0, nil
+	case AMF0_STRING, AMF0_LONG_STRING, AMF0_XML_DOCUMENT, AMF_DATA_XML:
+		return amfData.StrVal, nil
+	case AMF_DATA_BYTE_ARRAY:
+		return append([]byte{}, amfData.BytesVal...), nil
+	case AMF0_DATE:
+		return time.UnixMilli(int64(amfData.DateVal)), nil
+	case AMF0_NULL, AMF0_UNDEFINED, AMF0_UNSUPPORTED:
+		return nil, nil
+	}
+
+	id := amf3Identity(amfData)
+	if value, ok := d.naturals[id]; ok && id != (amfIdentity{}) {
+		return value, nil
+	}
+
+	switch amfData.DataType {
+	case AMF0_ECMA_ARRAY:
+		ecmaArray := make(Amf0EcmaArray, len(amfData.ObjMap))
+		d.remember(id, ecmaArray)
+		for key, item := range amfData.ObjMap {
+			value, err := d.natural(item)
+			if err != nil {
+				return nil, err
+			}
+			ecmaArray[key] = value
+		}
+		return ecmaArray, nil
+	case AMF_DATA_OBJECT, AMF0_TYPED_OBJECT:
+		objMap := make(map[string]interface{}, len(amfData.ObjMap))
+		d.remember(id, objMap)
+		for key, item := range amfData.ObjMap {
+			value, err := d.natural(item)
+			if err != nil {
+				return nil, err
+			}
+			objMap[key] = value
+		}
+		return objMap, nil
+	case AMF0_STRICT_ARRAY, AMF_DATA_VECTOR_INT, AMF_DATA_VECTOR_UINT, AMF_DATA_VECTOR_DOUBLE, AMF_DATA_VECTOR_OBJECT:
+		list := make([]interface{}, len(amfData.ObjList))
+		d.remember(id, list)
+		for i, item := range amfData.ObjList {
+			value, err := d.natural(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+
+	return nil, amf0TypeError(amfData, reflect.TypeOf((*interface{})(nil)).Elem())
+}
+
+// remember records what the object or array with identity id became.
+func (d *amf0Decoder) remember(id amfIdentity, value interface{}) {
+	if id == (amfIdentity{}) {
+		return
+	}
+	if d.naturals == nil {
+		d.naturals = make(map[amfIdentity]interface{})
+	}
+	d.naturals[id] = value
+}
+
+func amf0TypeError(amfData AmfData, t reflect.Type) error {
+	return fmt.Errorf("%w: can not put AMF0 type 0x%02X into %s", ErrAMFDecode, amfData.DataType, t)
+}
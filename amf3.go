@@ -0,0 +1,983 @@
+package rtmp
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "math"
+import "reflect"
+import "sort"
+import "unsafe"
+
+const (
+	AMF3_UNDEFINED     = 0x00
+	AMF3_NULL          = 0x01
+	AMF3_FALSE         = 0x02
+	AMF3_TRUE          = 0x03
+	AMF3_INTEGER       = 0x04
+	AMF3_DOUBLE        = 0x05
+	AMF3_STRING        = 0x06
+	AMF3_XML_DOCUMENT  = 0x07
+	AMF3_DATE          = 0x08
+	AMF3_ARRAY         = 0x09
+	AMF3_OBJECT        = 0x0A
+	AMF3_XML           = 0x0B
+	AMF3_BYTE_ARRAY    = 0x0C
+	AMF3_VECTOR_INT    = 0x0D
+	AMF3_VECTOR_UINT   = 0x0E
+	AMF3_VECTOR_DOUBLE = 0x0F
+	AMF3_VECTOR_OBJECT = 0x10
+	AMF3_DICTIONARY    = 0x11
+)
+
+// DataType values for the AMF3 values AMF0 has nothing like. XML comes with
+// StrVal and byte arrays with BytesVal. Vectors hold their items in ObjList,
+// numbers for all but object vectors, which name the item type in
+// ClassName; BoolVal is 1 for a vector of fixed length. Dictionaries hold
+// their keys and values in turn in ObjList, with BoolVal 1 for weak keys.
+const (
+	AMF_DATA_XML           = 0xF2
+	AMF_DATA_BYTE_ARRAY    = 0xF3
+	AMF_DATA_VECTOR_INT    = 0xF4
+	AMF_DATA_VECTOR_UINT   = 0xF5
+	AMF_DATA_VECTOR_DOUBLE = 0xF6
+	AMF_DATA_VECTOR_OBJECT = 0xF7
+	AMF_DATA_DICTIONARY    = 0xF8
+)
+
+// The range of numbers AMF3 writes as integers.
+const (
+	AMF3_INTEGER_MIN = -1 << 28
+	AMF3_INTEGER_MAX = 1<<28 - 1
+)
+
+// Amf3 reads and writes AMF3 into the same AmfData values as Amf0, so that
+// handlers need not care which encoding the peer used. Integers and doubles
+// both come as AMF0_NUMBER, strings as AMF0_STRING, dates as AMF0_DATE and
+// objects as AMF_DATA_OBJECT, or AMF0_TYPED_OBJECT when they name a class.
+// Arrays come as AMF0_STRICT_ARRAY with the dense part in ObjList and the
+// associative part, if any, in ObjMap.
+type Amf3 struct {
+	amfReader
+	buf bytes.Buffer
+
+	// The strings and traits read so far in the message, for references.
+	// Values are kept by amfReader as for Amf0.
+	readStrings []string
+	readTraits  []amf3Traits
+
+	// The same for what was written so far. Values are told apart by the
+	// identity of their map or list, and traits by their class name.
+	writeStrings map[string]int
+	writeRefs    map[amfIdentity]int
+	writeTraits  map[string]int
+	writeCount   int
+}
+
+type amf3Traits struct {
+	className      string
+	dynamic        bool
+	externalizable bool
+	members        []string
+}
+
+// ReadData is Amf0.ReadData for a payload in AMF3, such as the body of an
+// AMF3 data message after its format byte.
+func (a *Amf3) ReadData(aryData []byte, isProperty bool) (AmfData, error) {
+
+	if isProperty {
+		return a.readValue()
+	}
+
+	a.reset(aryData)
+	a.readStrings = nil
+	a.readTraits = nil
+
+	return a.readAll(a.readValue)
+}
+
+func (a *Amf3) readValue() (AmfData, error) {
+	if err := a.need(1, "value marker"); err != nil {
+		return AmfData{}, err
+	}
+
+	dataType := a.aryData[a.offset]
+
+	switch dataType {
+	case AMF3_UNDEFINED:
+		a.offset += 1
+		return AmfData{DataType: AMF0_UNDEFINED}, nil
+	case AMF3_NULL:
+		a.offset += 1
+		return AmfData{DataType: AMF0_NULL}, nil
+	case AMF3_FALSE:
+		a.offset += 1
+		return AmfData{DataType: AMF0_BOOLEAN, BoolVal: 0}, nil
+	case AMF3_TRUE:
+		a.offset += 1
+		return AmfData{DataType: AMF0_BOOLEAN, BoolVal: 1}, nil
+	case AMF3_INTEGER:
+		return a.readInteger()
+	case AMF3_DOUBLE:
+		return a.readDouble()
+	case AMF3_STRING:
+		return a.readString()
+	case AMF3_XML_DOCUMENT:
+		return a.readXml(AMF0_XML_DOCUMENT)
+	case AMF3_XML:
+		return a.readXml(AMF_DATA_XML)
+	case AMF3_DATE:
+		return a.readDate()
+	case AMF3_ARRAY:
+		return a.readArray()
+	case AMF3_OBJECT:
+		return a.readObject()
+	case AMF3_BYTE_ARRAY:
+		return a.readByteArray()
+	case AMF3_VECTOR_INT, AMF3_VECTOR_UINT, AMF3_VECTOR_DOUBLE, AMF3_VECTOR_OBJECT:
+		return a.readVector(dataType)
+	case AMF3_DICTIONARY:
+		return a.readDictionary()
+	}
+
+	return AmfData{}, a.errorf("unsupported AMF3 marker 0x%02X", dataType)
+}
+
+// readU29 reads a variable length integer of up to 29 bits: seven bits in
+// each of the first three bytes while their top bit is set, and all eight
+// of the fourth.
+func (a *Amf3) readU29() (uint32, error) {
+	var value uint32
+
+	for i := 0; i < 4; i++ {
+		if err := a.need(1, "variable length integer"); err != nil {
+			return 0, err
+		}
+
+		b := a.aryData[a.offset]
+		a.offset += 1
+
+		if i == 3 {
+			return value<<8 | uint32(b), nil
+		}
+
+		value = value<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return value, nil
+}
+
+func (a *Amf3) readInteger() (AmfData, error) {
+	a.offset += 1
+
+	value, err := a.readU29()
+	if err != nil {
+		return AmfData{}, err
+	}
+
+	// Sign-extend from 29 bits.
+	number := int32(value<<3) >> 3
+
+	return AmfData{DataType: AMF0_NUMBER, NumberVal: float64(number)}, nil
+}
+
+func (a *Amf3) readDouble() (AmfData, error) {
+	var amfData AmfData
+
+	if err := a.need(9, "double"); err != nil {
+		return amfData, err
+	}
+
+	amfData.DataType = AMF0_NUMBER
+	amfData.NumberVal = math.Float64frombits(binary.BigEndian.Uint64(a.aryData[a.offset+1 : a.offset+9]))
+
+	a.offset += 9
+
+	return amfData, nil
+}
+
+func (a *Amf3) readString() (AmfData, error) {
+	a.offset += 1
+
+	strVal, err := a.readUtf8()
+	if err != nil {
+		return AmfData{}, err
+	}
+
+	return AmfData{DataType: AMF0_STRING, StrVal: strVal}, nil
+}
+
+// readUtf8 reads a string that is either inline or a reference to one read
+// before. Strings serve as values, class names and property names alike.
+func (a *Amf3) readUtf8() (string, error) {
+	header, err := a.readU29()
+	if err != nil {
+		return "", err
+	}
+
+	if header&1 == 0 {
+		refIndex := header >> 1
+		if uint64(refIndex) >= uint64(len(a.readStrings)) {
+			return "", a.errorf("string reference %d to one of %d strings", refIndex, len(a.readStrings))
+		}
+		return a.readStrings[refIndex], nil
+	}
+
+	strLen := int(header >> 1)
+
+	if err := a.need(strLen, "string"); err != nil {
+		return "", err
+	}
+
+	strVal := string(a.aryData[a.offset : a.offset+strLen])
+
+	a.offset += strLen
+
+	// The empty string is never sent by reference.
+	if strVal != "" {
+		a.readStrings = append(a.readStrings, strVal)
+	}
+
+	return strVal, nil
+}
+
+// readHeader reads the marker and the integer that start a value kept for
+// references. It returns the value referred to when there is one, and else
+// what the integer goes on to say about the inline value.
+func (a *Amf3) readHeader() (uint32, *AmfData, error) {
+	a.offset += 1
+
+	header, err := a.readU29()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if header&1 == 0 {
+		amfData, err := a.readReference(header >> 1)
+		return 0, &amfData, err
+	}
+
+	return header >> 1, nil, nil
+}
+
+func (a *Amf3) readReference(refIndex uint32) (AmfData, error) {
+	var amfData AmfData
+
+	if uint64(refIndex) >= uint64(len(a.readRefs)) {
+		return amfData, a.errorf("reference %d to one of %d values", refIndex, len(a.readRefs))
+	}
+
+	if a.readRefDone[refIndex] {
+		return a.readRefs[refIndex], nil
+	}
+
+	// A value that encloses the reference, left unresolved as in Amf0.
+	if refIndex > 0xFFFF {
+		return amfData, a.errorf("reference %d to an enclosing value", refIndex)
+	}
+
+	amfData.DataType = AMF0_REFERENCE
+	amfData.RefIndex = uint16(refIndex)
+
+	return amfData, nil
+}
+
+// readXml reads an XML document or E4X XML, which share their encoding.
+func (a *Amf3) readXml(dataType byte) (AmfData, error) {
+	strLen, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.need(int(strLen), "XML"); err != nil {
+		return AmfData{}, err
+	}
+
+	var amfDataRet AmfData
+	amfDataRet.DataType = dataType
+	amfDataRet.StrVal = string(a.aryData[a.offset : a.offset+int(strLen)])
+
+	a.offset += int(strLen)
+
+	amfDataRet = a.setReadRef(a.addReadRef(), amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf3) readDate() (AmfData, error) {
+	_, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.need(8, "date"); err != nil {
+		return AmfData{}, err
+	}
+
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF0_DATE
+	amfDataRet.DateVal = math.Float64frombits(binary.BigEndian.Uint64(a.aryData[a.offset : a.offset+8]))
+
+	a.offset += 8
+
+	amfDataRet = a.setReadRef(a.addReadRef(), amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf3) readArray() (AmfData, error) {
+	aryLen, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.enter(); err != nil {
+		return AmfData{}, err
+	}
+	defer a.leave()
+
+	refIndex := a.addReadRef()
+
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF0_STRICT_ARRAY
+
+	// The associative part comes first and ends with the empty name.
+	for {
+		key, err := a.readUtf8()
+		if err != nil {
+			return amfDataRet, err
+		}
+
+		if key == "" {
+			break
+		}
+
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
+		}
+
+		if amfDataRet.ObjMap == nil {
+			amfDataRet.ObjMap = make(map[string]AmfData)
+		}
+		amfDataRet.ObjMap[key] = amfData
+	}
+
+	// Every value takes at least its marker byte.
+	if err := a.needItems(aryLen, 1, "array"); err != nil {
+		return amfDataRet, err
+	}
+
+	amfDataRet.ObjList = make([]AmfData, 0, amfListCap(aryLen))
+
+	for i := 0; i < int(aryLen); i++ {
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
+		}
+		amfDataRet.ObjList = append(amfDataRet.ObjList, amfData)
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf3) readObject() (AmfData, error) {
+	header, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	traits, err := a.readTraitsInfo(header)
+	if err != nil {
+		return AmfData{}, err
+	}
+
+	// The class alone knows how it wrote itself.
+	if traits.externalizable {
+		return AmfData{}, a.errorf("externalizable class %q", traits.className)
+	}
+
+	if err := a.enter(); err != nil {
+		return AmfData{}, err
+	}
+	defer a.leave()
+
+	refIndex := a.addReadRef()
+
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF_DATA_OBJECT
+	if traits.className != "" {
+		amfDataRet.DataType = AMF0_TYPED_OBJECT
+		amfDataRet.ClassName = traits.className
+	}
+	amfDataRet.ObjMap = make(map[string]AmfData)
+
+	for _, member := range traits.members {
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
+		}
+		amfDataRet.ObjMap[member] = amfData
+	}
+
+	for traits.dynamic {
+		key, err := a.readUtf8()
+		if err != nil {
+			return amfDataRet, err
+		}
+
+		if key == "" {
+			break
+		}
+
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
+		}
+		amfDataRet.ObjMap[key] = amfData
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+// readTraitsInfo reads the class of an object from what follows its header,
+// or looks it up when the header refers to one read before.
+func (a *Amf3) readTraitsInfo(header uint32) (amf3Traits, error) {
+	var traits amf3Traits
+
+	if header&1 == 0 {
+		refIndex := header >> 1
+		if uint64(refIndex) >= uint64(len(a.readTraits)) {
+			return traits, a.errorf("traits reference %d to one of %d", refIndex, len(a.readTraits))
+		}
+		return a.readTraits[refIndex], nil
+	}
+
+	traits.externalizable = header&2 != 0
+	traits.dynamic = header&4 != 0
+
+	className, err := a.readUtf8()
+	if err != nil {
+		return traits, err
+	}
+	traits.className = className
+
+	memberCount := header >> 3
+
+	// Every name takes at least a byte.
+	if err := a.needItems(memberCount, 1, "sealed members"); err != nil {
+		return traits, err
+	}
+
+	traits.members = make([]string, 0, amfListCap(memberCount))
+
+	for i := 0; i < int(memberCount); i++ {
+		member, err := a.readUtf8()
+		if err != nil {
+			return traits, err
+		}
+		traits.members = append(traits.members, member)
+	}
+
+	a.readTraits = append(a.readTraits, traits)
+
+	return traits, nil
+}
+
+func (a *Amf3) readByteArray() (AmfData, error) {
+	aryLen, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.need(int(aryLen), "byte array"); err != nil {
+		return AmfData{}, err
+	}
+
+	// The payload the bytes come from is reused once decoded.
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF_DATA_BYTE_ARRAY
+	amfDataRet.BytesVal = append([]byte{}, a.aryData[a.offset:a.offset+int(aryLen)]...)
+
+	a.offset += int(aryLen)
+
+	amfDataRet = a.setReadRef(a.addReadRef(), amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf3) readVector(marker byte) (AmfData, error) {
+	aryLen, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.need(1, "vector fixed flag"); err != nil {
+		return AmfData{}, err
+	}
+
+	var amfDataRet AmfData
+	amfDataRet.BoolVal = a.aryData[a.offset]
+	a.offset += 1
+
+	itemSize := 4
+	switch marker {
+	case AMF3_VECTOR_INT:
+		amfDataRet.DataType = AMF_DATA_VECTOR_INT
+	case AMF3_VECTOR_UINT:
+		amfDataRet.DataType = AMF_DATA_VECTOR_UINT
+	case AMF3_VECTOR_DOUBLE:
+		amfDataRet.DataType = AMF_DATA_VECTOR_DOUBLE
+		itemSize = 8
+	default:
+		amfDataRet.DataType = AMF_DATA_VECTOR_OBJECT
+		itemSize = 1
+
+		className, err := a.readUtf8()
+		if err != nil {
+			return amfDataRet, err
+		}
+		amfDataRet.ClassName = className
+	}
+
+	if err := a.needItems(aryLen, itemSize, "vector"); err != nil {
+		return amfDataRet, err
+	}
+
+	if err := a.enter(); err != nil {
+		return amfDataRet, err
+	}
+	defer a.leave()
+
+	refIndex := a.addReadRef()
+
+	amfDataRet.ObjList = make([]AmfData, 0, amfListCap(aryLen))
+
+	for i := 0; i < int(aryLen); i++ {
+		var amfData AmfData
+
+		switch amfDataRet.DataType {
+		case AMF_DATA_VECTOR_INT:
+			amfData.DataType = AMF0_NUMBER
+			amfData.NumberVal = float64(int32(binary.BigEndian.Uint32(a.aryData[a.offset:])))
+			a.offset += 4
+		case AMF_DATA_VECTOR_UINT:
+			amfData.DataType = AMF0_NUMBER
+			amfData.NumberVal = float64(binary.BigEndian.Uint32(a.aryData[a.offset:]))
+			a.offset += 4
+		case AMF_DATA_VECTOR_DOUBLE:
+			amfData.DataType = AMF0_NUMBER
+			amfData.NumberVal = math.Float64frombits(binary.BigEndian.Uint64(a.aryData[a.offset:]))
+			a.offset += 8
+		default:
+			amfData, err = a.readValue()
+			if err != nil {
+				return amfDataRet, err
+			}
+		}
+
+		amfDataRet.ObjList = append(amfDataRet.ObjList, amfData)
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func (a *Amf3) readDictionary() (AmfData, error) {
+	pairCount, ref, err := a.readHeader()
+	if err != nil || ref != nil {
+		return derefAmfData(ref), err
+	}
+
+	if err := a.need(1, "dictionary weak keys flag"); err != nil {
+		return AmfData{}, err
+	}
+
+	var amfDataRet AmfData
+	amfDataRet.DataType = AMF_DATA_DICTIONARY
+	amfDataRet.BoolVal = a.aryData[a.offset]
+	a.offset += 1
+
+	if err := a.needItems(pairCount, 2, "dictionary"); err != nil {
+		return amfDataRet, err
+	}
+
+	if err := a.enter(); err != nil {
+		return amfDataRet, err
+	}
+	defer a.leave()
+
+	refIndex := a.addReadRef()
+
+	amfDataRet.ObjList = make([]AmfData, 0, amfListCap(2*pairCount))
+
+	for i := 0; i < 2*int(pairCount); i++ {
+		amfData, err := a.readValue()
+		if err != nil {
+			return amfDataRet, err
+		}
+		amfDataRet.ObjList = append(amfDataRet.ObjList, amfData)
+	}
+
+	amfDataRet = a.setReadRef(refIndex, amfDataRet)
+
+	return amfDataRet, nil
+}
+
+func derefAmfData(amfData *AmfData) AmfData {
+	if amfData == nil {
+		return AmfData{}
+	}
+
+	return *amfData
+}
+
+func (a *Amf3) InitWrite() {
+	a.offset = 0
+	a.writeStrings = nil
+	a.writeRefs = nil
+	a.writeTraits = nil
+	a.writeCount = 0
+}
+
+func (a *Amf3) GetData() []byte {
+	return a.buf.Bytes()
+}
+
+// writeU29 writes the variable length integer readU29 reads. value must fit
+// in 29 bits.
+func (a *Amf3) writeU29(value uint32) {
+	switch {
+	case value < 0x80:
+		a.buf.WriteByte(byte(value))
+	case value < 0x4000:
+		a.buf.Write([]byte{byte(value>>7) | 0x80, byte(value) & 0x7F})
+	case value < 0x200000:
+		a.buf.Write([]byte{byte(value>>14) | 0x80, byte(value>>7) | 0x80, byte(value) & 0x7F})
+	default:
+		a.buf.Write([]byte{byte(value>>22) | 0x80, byte(value>>15) | 0x80, byte(value>>8) | 0x80, byte(value)})
+	}
+}
+
+// writeUtf8 writes a string, or a reference to it if it was written before.
+func (a *Amf3) writeUtf8(strVal string) {
+	if refIndex, ok := a.writeStrings[strVal]; ok {
+		a.writeU29(uint32(refIndex) << 1)
+		return
+	}
+
+	if strVal != "" {
+		if a.writeStrings == nil {
+			a.writeStrings = make(map[string]int)
+		}
+		a.writeStrings[strVal] = len(a.writeStrings)
+	}
+
+	a.writeU29(uint32(len(strVal))<<1 | 1)
+	a.buf.WriteString(strVal)
+}
+
+func (a *Amf3) WriteUndefined() {
+	a.buf.WriteByte(AMF3_UNDEFINED)
+}
+
+func (a *Amf3) WriteNull() {
+	a.buf.WriteByte(AMF3_NULL)
+}
+
+func (a *Amf3) WriteBoolean(boolVal bool) {
+	if boolVal {
+		a.buf.WriteByte(AMF3_TRUE)
+	} else {
+		a.buf.WriteByte(AMF3_FALSE)
+	}
+}
+
+// WriteInteger writes number as an integer if it lies between
+// AMF3_INTEGER_MIN and AMF3_INTEGER_MAX, and as a double otherwise.
+func (a *Amf3) WriteInteger(number int32) {
+	if number < AMF3_INTEGER_MIN || number > AMF3_INTEGER_MAX {
+		a.WriteDouble(float64(number))
+		return
+	}
+
+	a.buf.WriteByte(AMF3_INTEGER)
+	a.writeU29(uint32(number) & 0x1FFFFFFF)
+}
+
+func (a *Amf3) WriteDouble(number float64) {
+	tempAry := make([]byte, 8)
+	binary.BigEndian.PutUint64(tempAry, math.Float64bits(number))
+
+	a.buf.WriteByte(AMF3_DOUBLE)
+	a.buf.Write(tempAry)
+}
+
+// WriteNumber writes number as an integer when it is a whole one in the
+// integer range, and as a double otherwise.
+func (a *Amf3) WriteNumber(number float64) {
+	if number == math.Trunc(number) && number >= AMF3_INTEGER_MIN && number <= AMF3_INTEGER_MAX && !(number == 0 && math.Signbit(number)) {
+		a.WriteInteger(int32(number))
+		return
+	}
+
+	a.WriteDouble(number)
+}
+
+func (a *Amf3) WriteString(strVal string) {
+	a.buf.WriteByte(AMF3_STRING)
+	a.writeUtf8(strVal)
+}
+
+func (a *Amf3) WriteXmlDocument(strVal string) {
+	a.writeXml(AMF3_XML_DOCUMENT, strVal)
+}
+
+// WriteXml writes E4X XML, as opposed to the legacy XML document.
+func (a *Amf3) WriteXml(strVal string) {
+	a.writeXml(AMF3_XML, strVal)
+}
+
+func (a *Amf3) writeXml(marker byte, strVal string) {
+	a.writeCount++
+	a.buf.WriteByte(marker)
+	a.writeU29(uint32(len(strVal))<<1 | 1)
+	a.buf.WriteString(strVal)
+}
+
+// WriteDate writes a date given in milliseconds since the epoch.
+func (a *Amf3) WriteDate(dateVal float64) {
+	tempAry := make([]byte, 8)
+	binary.BigEndian.PutUint64(tempAry, math.Float64bits(dateVal))
+
+	a.writeCount++
+	a.buf.WriteByte(AMF3_DATE)
+	a.writeU29(1)
+	a.buf.Write(tempAry)
+}
+
+// WriteByteArray writes byteVal inline. WriteData also writes a reference
+// to a byte array it has written before.
+func (a *Amf3) WriteByteArray(byteVal []byte) {
+	a.writeCount++
+	a.buf.WriteByte(AMF3_BYTE_ARRAY)
+	a.writeU29(uint32(len(byteVal))<<1 | 1)
+	a.buf.Write(byteVal)
+}
+
+// WriteData writes a value as returned by ReadData, or by Amf0.ReadData.
+// Objects are written with their properties as dynamic members in key
+// order; an empty key can not be expressed and is left out. Objects, arrays,
+// vectors, dictionaries and byte arrays written before in the message are
+// written as references to them, telling them apart by the identity of
+// their ObjMap, ObjList or BytesVal. An AMF_DATA_ARRAY writes its values one
+// after the other, the way ReadData found them.
+//
+// An AMF0_REFERENCE left by either ReadData numbers values the way the
+// payload it came from did, which need not match how they are written here,
+// so it fails with an error wrapping ErrAMFEncode, leaving the output
+// incomplete.
+func (a *Amf3) WriteData(amfData AmfData) error {
+	switch amfData.DataType {
+	case AMF0_NUMBER:
+		a.WriteNumber(amfData.NumberVal)
+	case AMF0_BOOLEAN:
+		a.WriteBoolean(amfData.BoolVal != 0)
+	case AMF0_STRING, AMF0_LONG_STRING:
+		a.WriteString(amfData.StrVal)
+	case AMF0_XML_DOCUMENT:
+		a.WriteXmlDocument(amfData.StrVal)
+	case AMF_DATA_XML:
+		a.WriteXml(amfData.StrVal)
+	case AMF0_NULL:
+		a.WriteNull()
+	case AMF0_UNDEFINED, AMF0_UNSUPPORTED:
+		a.WriteUndefined()
+	case AMF0_DATE:
+		a.WriteDate(amfData.DateVal)
+	case AMF0_REFERENCE:
+		return fmt.Errorf("%w: unresolved reference %d", ErrAMFEncode, amfData.RefIndex)
+	case AMF_DATA_OBJECT, AMF0_OBJECT, AMF0_ECMA_ARRAY, AMF0_TYPED_OBJECT, AMF0_STRICT_ARRAY,
+		AMF_DATA_BYTE_ARRAY, AMF_DATA_VECTOR_INT, AMF_DATA_VECTOR_UINT, AMF_DATA_VECTOR_DOUBLE,
+		AMF_DATA_VECTOR_OBJECT, AMF_DATA_DICTIONARY:
+		return a.writeComplex(amfData)
+	case AMF_DATA_ARRAY:
+		return a.writeList(amfData.ObjList)
+	}
+
+	return nil
+}
+
+func (a *Amf3) writeList(list []AmfData) error {
+	for _, item := range list {
+		if err := a.WriteData(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeComplex writes a value kept for references, or a reference to it if
+// it was written before. Its index is taken before its contents are
+// written, so that it can contain itself.
+func (a *Amf3) writeComplex(amfData AmfData) error {
+	marker := amf3Marker(amfData.DataType)
+	id := amf3Identity(amfData)
+
+	if id != (amfIdentity{}) {
+		if refIndex, ok := a.writeRefs[id]; ok {
+			a.buf.WriteByte(marker)
+			a.writeU29(uint32(refIndex) << 1)
+			return nil
+		}
+
+		if a.writeRefs == nil {
+			a.writeRefs = make(map[amfIdentity]int)
+		}
+		a.writeRefs[id] = a.writeCount
+	}
+
+	a.writeCount++
+	a.buf.WriteByte(marker)
+
+	switch marker {
+	case AMF3_BYTE_ARRAY:
+		a.writeU29(uint32(len(amfData.BytesVal))<<1 | 1)
+		a.buf.Write(amfData.BytesVal)
+	case AMF3_ARRAY:
+		a.writeU29(uint32(len(amfData.ObjList))<<1 | 1)
+		if err := a.writeMembers(amfData.ObjMap); err != nil {
+			return err
+		}
+		return a.writeList(amfData.ObjList)
+	case AMF3_OBJECT:
+		a.writeTraitsInfo(amfData.ClassName)
+		return a.writeMembers(amfData.ObjMap)
+	case AMF3_DICTIONARY:
+		a.writeU29(uint32(len(amfData.ObjList)/2)<<1 | 1)
+		a.buf.WriteByte(amfData.BoolVal)
+		return a.writeList(amfData.ObjList[:len(amfData.ObjList)/2*2])
+	default:
+		return a.writeVector(marker, amfData)
+	}
+
+	return nil
+}
+
+// writeTraitsInfo writes the traits of a dynamic object with no sealed
+// members, or a reference to those of an earlier object of the same class.
+func (a *Amf3) writeTraitsInfo(className string) {
+	if refIndex, ok := a.writeTraits[className]; ok {
+		a.writeU29(uint32(refIndex)<<2 | 0x01)
+		return
+	}
+
+	if a.writeTraits == nil {
+		a.writeTraits = make(map[string]int)
+	}
+	a.writeTraits[className] = len(a.writeTraits)
+
+	// Inline object, inline traits, dynamic, no sealed members.
+	a.writeU29(0x0B)
+	a.writeUtf8(className)
+}
+
+// writeMembers writes properties by name in key order, followed by the
+// empty name that ends them.
+func (a *Amf3) writeMembers(objMap map[string]AmfData) error {
+	keys := make([]string, 0, len(objMap))
+	for key := range objMap {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		a.writeUtf8(key)
+		if err := a.WriteData(objMap[key]); err != nil {
+			return err
+		}
+	}
+
+	a.writeUtf8("")
+
+	return nil
+}
+
+func (a *Amf3) writeVector(marker byte, amfData AmfData) error {
+	a.writeU29(uint32(len(amfData.ObjList))<<1 | 1)
+	a.buf.WriteByte(amfData.BoolVal)
+
+	if marker == AMF3_VECTOR_OBJECT {
+		a.writeUtf8(amfData.ClassName)
+	}
+
+	tempAry := make([]byte, 8)
+
+	for _, item := range amfData.ObjList {
+		switch marker {
+		case AMF3_VECTOR_INT:
+			binary.BigEndian.PutUint32(tempAry, uint32(int32(item.NumberVal)))
+			a.buf.Write(tempAry[:4])
+		case AMF3_VECTOR_UINT:
+			binary.BigEndian.PutUint32(tempAry, uint32(item.NumberVal))
+			a.buf.Write(tempAry[:4])
+		case AMF3_VECTOR_DOUBLE:
+			binary.BigEndian.PutUint64(tempAry, math.Float64bits(item.NumberVal))
+			a.buf.Write(tempAry)
+		default:
+			if err := a.WriteData(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// amf3Marker returns the marker a value kept for references is written
+// with.
+func amf3Marker(dataType byte) byte {
+	switch dataType {
+	case AMF_DATA_BYTE_ARRAY:
+		return AMF3_BYTE_ARRAY
+	case AMF0_STRICT_ARRAY, AMF0_ECMA_ARRAY:
+		return AMF3_ARRAY
+	case AMF_DATA_VECTOR_INT:
+		return AMF3_VECTOR_INT
+	case AMF_DATA_VECTOR_UINT:
+		return AMF3_VECTOR_UINT
+	case AMF_DATA_VECTOR_DOUBLE:
+		return AMF3_VECTOR_DOUBLE
+	case AMF_DATA_VECTOR_OBJECT:
+		return AMF3_VECTOR_OBJECT
+	case AMF_DATA_DICTIONARY:
+		return AMF3_DICTIONARY
+	}
+
+	return AMF3_OBJECT
+}
+
+// amf3Identity returns what tells one value apart from an equal copy: its
+// list, map or bytes. Empty values have none.
+func amf3Identity(amfData AmfData) amfIdentity {
+	switch {
+	case len(amfData.ObjList) > 0:
+		return amfIdentity{unsafe.Pointer(unsafe.SliceData(amfData.ObjList)), len(amfData.ObjList)}
+	case amfData.ObjMap != nil:
+		return amfIdentity{p: reflect.ValueOf(amfData.ObjMap).UnsafePointer()}
+	case len(amfData.BytesVal) > 0:
+		return amfIdentity{unsafe.Pointer(unsafe.SliceData(amfData.BytesVal)), len(amfData.BytesVal)}
+	}
+
+	return amfIdentity{}
+}
@@ -0,0 +1,104 @@
+package rtmp
+
+import "fmt"
+
+// amfReader is the decoding state Amf0 and Amf3 share: the payload, how far
+// into it they are, how deep objects nest there, and the values read so far
+// that references can point to.
+type amfReader struct {
+	offset  int
+	aryData []byte
+
+	readRefs    []AmfData
+	readRefDone []bool
+	depth       int
+}
+
+// reset starts decoding aryData from its beginning.
+func (r *amfReader) reset(aryData []byte) {
+	r.offset = 0
+	r.aryData = aryData
+	r.depth = 0
+	r.readRefs = nil
+	r.readRefDone = nil
+}
+
+// readAll reads values with readValue until the payload ends, into an
+// AMF_DATA_ARRAY, stopping at the first error.
+func (r *amfReader) readAll(readValue func() (AmfData, error)) (AmfData, error) {
+	var amfDataObj AmfData
+	amfDataObj.DataType = AMF_DATA_ARRAY
+
+	for r.offset < len(r.aryData) {
+		amfDataObjRet, err := readValue()
+		if err != nil {
+			return amfDataObj, err
+		}
+
+		amfDataObj.ObjList = append(amfDataObj.ObjList, amfDataObjRet)
+	}
+
+	return amfDataObj, nil
+}
+
+// need checks that n more bytes are left for what is read next.
+func (r *amfReader) need(n int, what string) error {
+	if n > len(r.aryData)-r.offset {
+		return r.errorf("%s needs %d bytes, %d left", what, n, len(r.aryData)-r.offset)
+	}
+
+	return nil
+}
+
+// needItems checks that count items of at least size bytes each can be
+// left, before room is made for them.
+func (r *amfReader) needItems(count uint32, size int, what string) error {
+	if uint64(count)*uint64(size) > uint64(len(r.aryData)-r.offset) {
+		return r.errorf("%s of %d items in %d bytes", what, count, len(r.aryData)-r.offset)
+	}
+
+	return nil
+}
+
+func (r *amfReader) errorf(format string, args ...interface{}) error {
+	return &AmfDecodeError{Offset: r.offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// enter counts one more level of objects and arrays, failing past
+// AMF_MAX_DEPTH so that hostile input can not exhaust the stack.
+func (r *amfReader) enter() error {
+	if r.depth >= AMF_MAX_DEPTH {
+		return r.errorf("nesting deeper than %d", AMF_MAX_DEPTH)
+	}
+
+	r.depth++
+
+	return nil
+}
+
+func (r *amfReader) leave() {
+	r.depth--
+}
+
+// addReadRef reserves the reference index of an object or array as its
+// reading starts, so that the ones nested in it are numbered after it.
+func (r *amfReader) addReadRef() int {
+	r.readRefs = append(r.readRefs, AmfData{})
+	r.readRefDone = append(r.readRefDone, false)
+
+	return len(r.readRefs) - 1
+}
+
+// setReadRef completes the entry reserved by addReadRef and returns amfData
+// with its index in RefIndex, so that a writer can tell which value a
+// reference left unresolved inside it points to.
+func (r *amfReader) setReadRef(refIndex int, amfData AmfData) AmfData {
+	if refIndex <= 0xFFFF {
+		amfData.RefIndex = uint16(refIndex)
+	}
+
+	r.readRefs[refIndex] = amfData
+	r.readRefDone[refIndex] = true
+
+	return amfData
+}
@@ -0,0 +1,52 @@
+package rtmp
+
+import "sync"
+
+// Message bodies are pooled in power of two size classes from 128 bytes to
+// 1 MiB. Larger bodies are left to the garbage collector.
+const (
+	bodyPoolMinShift = 7
+	bodyPoolMaxShift = 20
+)
+
+// A body is first given room for at most this much, so that a header
+// announcing a large message costs nothing until its data actually arrives.
+const bodyInitialSize = 64 * 1024
+
+var bodyPools [bodyPoolMaxShift - bodyPoolMinShift + 1]sync.Pool
+
+// getBody returns an empty slice with room for size bytes, or for
+// bodyInitialSize if size is larger.
+func getBody(size int) []byte {
+	if size > bodyInitialSize {
+		size = bodyInitialSize
+	}
+
+	class := 0
+	for 1<<(class+bodyPoolMinShift) < size {
+		class++
+	}
+
+	if b, ok := bodyPools[class].Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+
+	return make([]byte, 0, 1<<(class+bodyPoolMinShift))
+}
+
+// putBody hands b back for reuse. b must not be used afterwards.
+func putBody(b []byte) {
+	c := cap(b)
+	if c < 1<<bodyPoolMinShift || c > 1<<bodyPoolMaxShift {
+		return
+	}
+
+	// File it under the largest class it can hold.
+	class := 0
+	for 1<<(class+1+bodyPoolMinShift) <= c {
+		class++
+	}
+
+	b = b[:0]
+	bodyPools[class].Put(&b)
+}
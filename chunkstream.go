@@ -0,0 +1,70 @@
+package rtmp
+
+// RtmpChunkStream holds the header of the last message seen on one chunk
+// stream, which fmt 1/2/3 chunk headers are resolved against, along with the
+// body received so far for a message still arriving in chunks. RtmpConn keeps
+// one table of these for each direction.
+type RtmpChunkStream struct {
+	chunkStreamId int
+	bodySize      int
+	packetType    int
+	streamId      uint32
+	timeStamp     uint32
+	timeDelta     uint32
+	hasTimeDelta  bool
+	hasExtendedTs bool
+	hasHeader     bool
+	bodyData      []byte
+	started       bool
+}
+
+func (s *RtmpChunkStream) Init(chunkStreamId int) {
+	s.chunkStreamId = chunkStreamId
+	s.bodySize = 0
+	s.packetType = 0
+	s.streamId = 0
+	s.timeStamp = 0
+	s.timeDelta = 0
+	s.hasTimeDelta = false
+	s.hasExtendedTs = false
+	s.hasHeader = false
+	s.bodyData = nil
+	s.started = false
+}
+
+func (s *RtmpChunkStream) GetChunkStreamId() int {
+	return s.chunkStreamId
+}
+
+func (s *RtmpChunkStream) GetBodySize() int {
+	return s.bodySize
+}
+
+func (s *RtmpChunkStream) GetPacketType() int {
+	return s.packetType
+}
+
+func (s *RtmpChunkStream) GetStreamId() uint32 {
+	return s.streamId
+}
+
+func (s *RtmpChunkStream) GetTimeStamp() uint32 {
+	return s.timeStamp
+}
+
+func (s *RtmpChunkStream) GetTimeDelta() uint32 {
+	return s.timeDelta
+}
+
+// IsPending reports whether a message on this chunk stream has been started
+// but not all of its chunks have arrived yet.
+func (s *RtmpChunkStream) IsPending() bool {
+	return s.started
+}
+
+// Abort drops the partial message, keeping the header state for the chunks
+// that follow.
+func (s *RtmpChunkStream) Abort() {
+	s.bodyData = nil
+	s.started = false
+}
@@ -0,0 +1,66 @@
+package rtmp
+
+import "errors"
+import "fmt"
+
+// Errors returned by the chunk layer and the connection. Failures carry more
+// detail by wrapping one of these, so test for them with errors.Is.
+var (
+	// ErrShortBuffer means the input ends before the chunk does. It is not
+	// a protocol violation; decoding can resume once more data arrives.
+	ErrShortBuffer = errors.New("rtmp: short buffer")
+
+	// ErrMalformedChunk means a chunk header can not be interpreted, such
+	// as a compressed header on a chunk stream that never had a full one.
+	ErrMalformedChunk = errors.New("rtmp: malformed chunk")
+
+	// ErrMalformedMessage means a protocol control or user control message
+	// is too short or carries an invalid value.
+	ErrMalformedMessage = errors.New("rtmp: malformed message")
+
+	// ErrMessageTooLarge means a message is larger than the connection
+	// accepts, or the partial messages held for the peer take up too much
+	// memory.
+	ErrMessageTooLarge = errors.New("rtmp: message too large")
+
+	// ErrAMFDecode means an AMF payload could not be decoded.
+	ErrAMFDecode = errors.New("rtmp: amf decode failed")
+
+	// ErrAMFEncode means a Go value could not be marshaled to AMF.
+	ErrAMFEncode = errors.New("rtmp: amf encode failed")
+
+	// ErrHandshake means the handshake with the peer failed, for example
+	// on an unsupported version or a digest that does not verify.
+	ErrHandshake = errors.New("rtmp: handshake failed")
+
+	// ErrInvalidChunkSize means a chunk size outside [1, 0x7FFFFFFF] was
+	// asked for.
+	ErrInvalidChunkSize = errors.New("rtmp: invalid chunk size")
+
+	// ErrInvalidChunkStream means a message was to be sent on a chunk
+	// stream ID outside [2, 65599], which no basic header can carry.
+	ErrInvalidChunkStream = errors.New("rtmp: invalid chunk stream id")
+
+	// ErrAborted means the message being sent was cut short by
+	// AbortMessage.
+	ErrAborted = errors.New("rtmp: message aborted")
+
+	// ErrConnClosed means a message was sent on a connection that has
+	// already been closed.
+	ErrConnClosed = errors.New("rtmp: connection closed")
+)
+
+// AmfDecodeError reports where and why an AMF payload could not be decoded.
+// It matches ErrAMFDecode with errors.Is.
+type AmfDecodeError struct {
+	Offset int
+	Reason string
+}
+
+func (e *AmfDecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", ErrAMFDecode, e.Offset, e.Reason)
+}
+
+func (e *AmfDecodeError) Unwrap() error {
+	return ErrAMFDecode
+}
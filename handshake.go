@@ -3,16 +3,79 @@ package rtmp
 import "time"
 import "math/rand"
 import "encoding/binary"
+import "crypto/hmac"
+import "crypto/sha256"
+import "bytes"
+import "math/big"
+import "net"
+import "fmt"
 
+const (
+	HANDSHAKE_SIZE = 1536
+
+	// In schema 0 the 764 byte key block comes before the digest block, in
+	// schema 1 the digest block comes first.
+	HANDSHAKE_SCHEMA_SIMPLE = -1
+	HANDSHAKE_SCHEMA_0      = 0
+	HANDSHAKE_SCHEMA_1      = 1
+
+	handshakeDigestLen = 32
+)
+
+// GenuineFMSKey signs S1 and S2. Its first 36 bytes are the text
+// "Genuine Adobe Flash Media Server 001".
+var GenuineFMSKey = []byte{
+	0x47, 0x65, 0x6e, 0x75, 0x69, 0x6e, 0x65, 0x20,
+	0x41, 0x64, 0x6f, 0x62, 0x65, 0x20, 0x46, 0x6c,
+	0x61, 0x73, 0x68, 0x20, 0x4d, 0x65, 0x64, 0x69,
+	0x61, 0x20, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x20, 0x30, 0x30, 0x31,
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8,
+	0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
+// GenuineFPKey signs C1 and C2. Its first 30 bytes are the text
+// "Genuine Adobe Flash Player 001".
+var GenuineFPKey = []byte{
+	0x47, 0x65, 0x6e, 0x75, 0x69, 0x6e, 0x65, 0x20,
+	0x41, 0x64, 0x6f, 0x62, 0x65, 0x20, 0x46, 0x6c,
+	0x61, 0x73, 0x68, 0x20, 0x50, 0x6c, 0x61, 0x79,
+	0x65, 0x72, 0x20, 0x30, 0x30, 0x31,
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8,
+	0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
+var serverVersion = []byte{0x04, 0x05, 0x00, 0x01}
+var clientVersion = []byte{0x09, 0x00, 0x7c, 0x02}
+
+// HandShakeBuf builds our side of the handshake. The digest ("complex")
+// handshake is used whenever the peer's C1 or S1 carries a version, the
+// simple one when it is zero. RTMPE (version 6) adds a Diffie-Hellman key
+// exchange to the digest handshake.
 type HandShakeBuf struct {
-	aryData []byte
+	aryData     []byte
+	schema      int
+	localDigest []byte
+	peerDigest  []byte
+	encrypted   bool
+	dhPrivate   *big.Int
+	localPubKey []byte
+	peerPubKey  []byte
+	sharedKey   []byte
 }
 
-func (h *HandShakeBuf) InitBuf() {
+// InitBuf builds S0+S1+S2 in reply to the client's C0+C1.
+func (h *HandShakeBuf) InitBuf(c0c1 []byte) error {
 
-	h.aryData = make([]byte, 3073)
+	h.aryData = make([]byte, 1+HANDSHAKE_SIZE*2)
 
-	h.aryData[0] = 0x03
+	h.encrypted = c0c1[0] == RTMPE_VERSION
+
+	h.aryData[0] = c0c1[0]
 	curTs := time.Now()
 
 	intBuf := make([]byte, 4)
@@ -26,12 +89,284 @@ func (h *HandShakeBuf) InitBuf() {
 		h.aryData[i+5] = 0x0
 	}
 
-	for i := 9; i < 3073; i++ {
+	for i := 9; i < len(h.aryData); i++ {
 		h.aryData[i] = byte(rand.Intn(256))
 	}
 
+	c1 := c0c1[1 : 1+HANDSHAKE_SIZE]
+	h.schema, h.peerDigest = findDigest(c1, GenuineFPKey[:30])
+	if h.schema == HANDSHAKE_SCHEMA_SIMPLE {
+		if h.encrypted {
+			return fmt.Errorf("%w: RTMPE without a valid C1 digest", ErrHandshake)
+		}
+
+		// S2 echoes C1, with time2 set to when C1 was read.
+		s2 := h.aryData[1+HANDSHAKE_SIZE:]
+		copy(s2, c1)
+		binary.BigEndian.PutUint32(s2[4:8], uint32(curTs.Unix()))
+		return nil
+	}
+
+	s1 := h.aryData[1 : 1+HANDSHAKE_SIZE]
+	copy(s1[4:8], serverVersion)
+
+	// The public key is covered by the digest, so it goes in first.
+	if h.encrypted {
+		if err := h.exchangeKeys(c1, s1); err != nil {
+			return err
+		}
+	}
+
+	h.localDigest = writeDigest(s1, h.schema, GenuineFMSKey[:36])
+
+	s2 := h.aryData[1+HANDSHAKE_SIZE:]
+	writeResponseDigest(s2, GenuineFMSKey, h.peerDigest)
+
+	return nil
+}
+
+// exchangeKeys reads the peer's public key from peerSig, writes ours into
+// localSig and derives the shared secret.
+func (h *HandShakeBuf) exchangeKeys(peerSig []byte, localSig []byte) error {
+	if h.dhPrivate == nil {
+		var err error
+		h.dhPrivate, h.localPubKey, err = rtmpeGenerateKey()
+		if err != nil {
+			return fmt.Errorf("%w: generate RTMPE key: %w", ErrHandshake, err)
+		}
+	}
+
+	offset := rtmpeKeyOffset(localSig, h.schema)
+	copy(localSig[offset:offset+rtmpeDHKeyLen], h.localPubKey)
+
+	if peerSig == nil {
+		return nil
+	}
+
+	offset = rtmpeKeyOffset(peerSig, h.schema)
+	h.peerPubKey = append([]byte(nil), peerSig[offset:offset+rtmpeDHKeyLen]...)
+
+	sharedKey, ok := rtmpeSharedKey(h.dhPrivate, h.peerPubKey)
+	if !ok {
+		return fmt.Errorf("%w: invalid RTMPE public key", ErrHandshake)
+	}
+
+	h.sharedKey = sharedKey
+
+	return nil
+}
+
+func (h *HandShakeBuf) IsEncrypted() bool {
+	return h.encrypted
+}
+
+// NewEncryptedConn wraps conn with the RC4 streams keyed by the RTMPE
+// exchange. It is only valid once the handshake has completed.
+func (h *HandShakeBuf) NewEncryptedConn(conn net.Conn) (*rtmpeConn, error) {
+	if h.sharedKey == nil {
+		return nil, fmt.Errorf("%w: RTMPE keys were not exchanged", ErrHandshake)
+	}
+
+	return newRtmpeConn(conn, h.sharedKey, h.localPubKey, h.peerPubKey)
+}
+
+// ValidateC2 checks the client's C2 against the S1 we sent: a simple C2 must
+// echo S1's time and random bytes, a complex one must be signed with a key
+// derived from S1's digest.
+func (h *HandShakeBuf) ValidateC2(c2 []byte) bool {
+	if h.schema == HANDSHAKE_SCHEMA_SIMPLE {
+		s1 := h.aryData[1 : 1+HANDSHAKE_SIZE]
+		return bytes.Equal(c2[:4], s1[:4]) && bytes.Equal(c2[8:HANDSHAKE_SIZE], s1[8:])
+	}
+
+	return checkResponseDigest(c2, GenuineFPKey, h.localDigest)
+}
+
+// InitClientBuf builds C0+C1. A complex C1 carries a digest in the given
+// schema, a simple one has a zero version. An encrypted C1 is always complex
+// and also carries our public key.
+func (h *HandShakeBuf) InitClientBuf(complex bool, schema int, encrypted bool) error {
+
+	h.aryData = make([]byte, 1+HANDSHAKE_SIZE)
+
+	h.encrypted = encrypted
+
+	h.aryData[0] = RTMP_VERSION
+	if encrypted {
+		h.aryData[0] = RTMPE_VERSION
+		complex = true
+	}
+
+	binary.BigEndian.PutUint32(h.aryData[1:5], uint32(time.Now().Unix()))
+
+	for i := 9; i < len(h.aryData); i++ {
+		h.aryData[i] = byte(rand.Intn(256))
+	}
+
+	h.schema = HANDSHAKE_SCHEMA_SIMPLE
+	if !complex {
+		return nil
+	}
+
+	c1 := h.aryData[1:]
+	copy(c1[4:8], clientVersion)
+	h.schema = schema
+
+	if encrypted {
+		if err := h.exchangeKeys(nil, c1); err != nil {
+			return err
+		}
+	}
+
+	h.localDigest = writeDigest(c1, schema, GenuineFPKey[:30])
+
+	return nil
+}
+
+// ValidateS1 checks the digest of the server's S1 when we sent a complex C1.
+// A server that answers with a simple S1 is accepted as well.
+func (h *HandShakeBuf) ValidateS1(s1 []byte) bool {
+	if h.schema == HANDSHAKE_SCHEMA_SIMPLE || binary.BigEndian.Uint32(s1[4:8]) == 0 {
+		return true
+	}
+
+	schema, digest := findDigest(s1, GenuineFMSKey[:36])
+	if schema == HANDSHAKE_SCHEMA_SIMPLE {
+		return false
+	}
+
+	h.peerDigest = digest
+
+	return true
+}
+
+// ProcessS1Keys derives the RTMPE shared secret from the server's S1.
+func (h *HandShakeBuf) ProcessS1Keys(s1 []byte) error {
+	if !h.encrypted {
+		return nil
+	}
+
+	if binary.BigEndian.Uint32(s1[4:8]) == 0 {
+		return fmt.Errorf("%w: RTMPE answered with a simple S1", ErrHandshake)
+	}
+
+	offset := rtmpeKeyOffset(s1, h.schema)
+	h.peerPubKey = append([]byte(nil), s1[offset:offset+rtmpeDHKeyLen]...)
+
+	sharedKey, ok := rtmpeSharedKey(h.dhPrivate, h.peerPubKey)
+	if !ok {
+		return fmt.Errorf("%w: invalid RTMPE public key", ErrHandshake)
+	}
+
+	h.sharedKey = sharedKey
+
+	return nil
+}
+
+// ValidateS2 checks that S2 echoes our C1 or, in the digest handshake, that
+// it is signed with a key derived from our C1 digest.
+func (h *HandShakeBuf) ValidateS2(s2 []byte) bool {
+	if h.schema == HANDSHAKE_SCHEMA_SIMPLE || h.peerDigest == nil {
+		c1 := h.aryData[1 : 1+HANDSHAKE_SIZE]
+		return bytes.Equal(s2[:4], c1[:4]) && bytes.Equal(s2[8:HANDSHAKE_SIZE], c1[8:])
+	}
+
+	return checkResponseDigest(s2, GenuineFMSKey, h.localDigest)
+}
+
+// BuildC2 returns C2 in reply to the server's S1.
+func (h *HandShakeBuf) BuildC2(s1 []byte) []byte {
+	c2 := make([]byte, HANDSHAKE_SIZE)
+
+	if h.schema == HANDSHAKE_SCHEMA_SIMPLE || h.peerDigest == nil {
+		copy(c2, s1)
+		return c2
+	}
+
+	for i := 0; i < len(c2); i++ {
+		c2[i] = byte(rand.Intn(256))
+	}
+
+	writeResponseDigest(c2, GenuineFPKey, h.peerDigest)
+
+	return c2
+}
+
+func (h *HandShakeBuf) IsComplex() bool {
+	return h.schema != HANDSHAKE_SCHEMA_SIMPLE
+}
+
+func (h *HandShakeBuf) GetSchema() int {
+	return h.schema
 }
 
 func (h *HandShakeBuf) GetBuf() []byte {
 	return h.aryData
 }
+
+// digestOffset returns where the 32 byte digest sits inside a 1536 byte
+// C1/S1. The four bytes opening the digest block pick the offset.
+func digestOffset(b []byte, schema int) int {
+	base := 8
+	if schema == HANDSHAKE_SCHEMA_0 {
+		base = 8 + 764
+	}
+
+	offset := int(b[base]) + int(b[base+1]) + int(b[base+2]) + int(b[base+3])
+
+	return base + 4 + offset%728
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+
+	return mac.Sum(nil)
+}
+
+// calcDigest signs b, leaving out the digest itself.
+func calcDigest(b []byte, offset int, key []byte) []byte {
+	return hmacSha256(key, b[:offset], b[offset+handshakeDigestLen:])
+}
+
+func writeDigest(b []byte, schema int, key []byte) []byte {
+	offset := digestOffset(b, schema)
+	digest := calcDigest(b, offset, key)
+	copy(b[offset:], digest)
+
+	return digest
+}
+
+// findDigest tries both schemas on a C1 or S1 and returns the one whose
+// digest checks out, or HANDSHAKE_SCHEMA_SIMPLE.
+func findDigest(b []byte, key []byte) (int, []byte) {
+	if binary.BigEndian.Uint32(b[4:8]) == 0 {
+		return HANDSHAKE_SCHEMA_SIMPLE, nil
+	}
+
+	for _, schema := range []int{HANDSHAKE_SCHEMA_0, HANDSHAKE_SCHEMA_1} {
+		offset := digestOffset(b, schema)
+		digest := calcDigest(b, offset, key)
+		if hmac.Equal(digest, b[offset:offset+handshakeDigestLen]) {
+			return schema, digest
+		}
+	}
+
+	return HANDSHAKE_SCHEMA_SIMPLE, nil
+}
+
+// writeResponseDigest signs S2 or C2 with a key derived from the digest of
+// the C1 or S1 it answers, placing the signature in the last 32 bytes.
+func writeResponseDigest(b []byte, key []byte, peerDigest []byte) {
+	signKey := hmacSha256(key, peerDigest)
+	copy(b[HANDSHAKE_SIZE-handshakeDigestLen:], hmacSha256(signKey, b[:HANDSHAKE_SIZE-handshakeDigestLen]))
+}
+
+func checkResponseDigest(b []byte, key []byte, localDigest []byte) bool {
+	signKey := hmacSha256(key, localDigest)
+	digest := hmacSha256(signKey, b[:HANDSHAKE_SIZE-handshakeDigestLen])
+
+	return hmac.Equal(digest, b[HANDSHAKE_SIZE-handshakeDigestLen:HANDSHAKE_SIZE])
+}
@@ -3,3 +3,23 @@ package rtmp
 type InvokeProc interface {
 	OnInvokeProc(string, AmfData, *RtmpConn)
 }
+
+// UserControlProc is implemented by invoke handlers that want to see User
+// Control events, such as the buffer length a client asks for. Ping requests
+// are answered before the handler is called.
+type UserControlProc interface {
+	OnUserControl(UserControlEvent, *RtmpConn)
+}
+
+// ConnStateProc is implemented by Server handlers that want to know when a
+// connection is accepted and when its read loop ends.
+type ConnStateProc interface {
+	OnConnOpen(*RtmpConn)
+	OnConnClose(*RtmpConn)
+}
+
+// ErrorProc is implemented by invoke handlers that want to know why a
+// connection failed: a protocol violation, a failed write or a timeout.
+type ErrorProc interface {
+	OnError(error, *RtmpConn)
+}
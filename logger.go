@@ -0,0 +1,19 @@
+package rtmp
+
+import "log/slog"
+import "sync/atomic"
+
+// LevelTrace is below slog.LevelDebug and used for per-chunk traces, which
+// are only worth enabling for the connections being looked into.
+const LevelTrace = slog.LevelDebug - 4
+
+var lastConnId atomic.Uint64
+
+// nextConnId returns the ID attached to the log records of a new connection.
+func nextConnId() uint64 {
+	return lastConnId.Add(1)
+}
+
+// discardLogger is used until a logger is set, so that the package stays
+// silent by default.
+var discardLogger = slog.New(slog.DiscardHandler)
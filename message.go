@@ -0,0 +1,82 @@
+package rtmp
+
+const (
+	RTMP_COMMAND_CHUNK_STREAM = 3
+	RTMP_AUDIO_CHUNK_STREAM   = 4
+	RTMP_DATA_CHUNK_STREAM    = 5
+	RTMP_VIDEO_CHUNK_STREAM   = 6
+)
+
+// RtmpMessage is a whole message as returned by ReadMessage and taken by
+// WriteMessage. TimeStamp is the absolute timestamp in milliseconds. A
+// ChunkStreamId below 2 lets WriteMessage pick one from MessageType.
+type RtmpMessage struct {
+	ChunkStreamId int
+	StreamId      uint32
+	MessageType   int
+	TimeStamp     uint32
+	Payload       []byte
+}
+
+// Release hands the payload back for reuse by later messages. It is
+// optional, and m.Payload must not be used afterwards.
+func (m *RtmpMessage) Release() {
+	putBody(m.Payload)
+	m.Payload = nil
+}
+
+// ReadData decodes the values in the payload of a command or data message,
+// sent as AMF0 or AMF3.
+func (m *RtmpMessage) ReadData() (AmfData, error) {
+	var amf Amf0
+	return amf.ReadData(amfPayload(m.MessageType, m.Payload), false)
+}
+
+func newRtmpMessage(p RtmpPacket) *RtmpMessage {
+	return &RtmpMessage{
+		ChunkStreamId: p.GetChunkStreamId(),
+		StreamId:      p.GetStreamId(),
+		MessageType:   p.GetPacketType(),
+		TimeStamp:     p.GetTimeStamp(),
+		Payload:       p.GetBodyData(),
+	}
+}
+
+// amfPayload returns the AMF0 values in the payload of a command or data
+// message, leaving out the format byte of the AMF3 message types.
+func amfPayload(packetType int, bodyData []byte) []byte {
+	if packetType != AMF_TYPE_INVOKE_AMF3 && packetType != AMF_TYPE_NOTIFY_AMF3 {
+		return bodyData
+	}
+
+	if len(bodyData) > 0 && bodyData[0] == 0x00 {
+		return bodyData[1:]
+	}
+
+	return bodyData
+}
+
+// isControlMessage reports whether packetType is one of the protocol control
+// messages the connection always handles itself.
+func isControlMessage(packetType int) bool {
+	return packetType >= AMF_SET_CHUNKSIZE && packetType <= AMF_BAND_WIDTH
+}
+
+// defaultChunkStream returns the chunk stream a message of packetType is
+// sent on when the caller does not name one.
+func defaultChunkStream(packetType int) int {
+	switch packetType {
+	case AMF_TYPE_AUDIO:
+		return RTMP_AUDIO_CHUNK_STREAM
+	case AMF_TYPE_VIDEO:
+		return RTMP_VIDEO_CHUNK_STREAM
+	case AMF_TYPE_NOTIFY, AMF_TYPE_NOTIFY_AMF3:
+		return RTMP_DATA_CHUNK_STREAM
+	}
+
+	if isControlMessage(packetType) {
+		return RTMP_CONTROL_CHUNK_STREAM
+	}
+
+	return RTMP_COMMAND_CHUNK_STREAM
+}
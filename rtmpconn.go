@@ -1,32 +1,164 @@
 package rtmp
 
 import "fmt"
+import "context"
+import "bufio"
 import "net"
-import "time"
 import "encoding/binary"
-import "math/rand"
 import "sync"
+import "sync/atomic"
+import "time"
+import "io"
+import "errors"
+import "log/slog"
 
 type RtmpConn struct {
-	conn          net.Conn
-	aryData       []byte
-	chunkSize     int
-	preBodySize   int
-	preTimeStamp  int
-	prePacketType int
-	handshakeC0   bool
-	handshakeC2   bool
-	dataLock      sync.Mutex
-	invokeHandler InvokeProc
-	chunkStreamId byte
+	conn             net.Conn
+	aryData          []byte
+	recvBuf          []byte
+	recvNeed         int
+	maxMessageSize   int
+	maxPendingSize   int
+	pendingSize      int
+	chunkSize        int
+	recvChunkSize    int
+	sendChunkSize    int
+	chunkStreams     map[int]*RtmpChunkStream
+	sendStreams      map[int]*RtmpChunkStream
+	sendLock         sync.Mutex
+	abortLock        sync.Mutex
+	sendInFlight     map[int]int
+	sendAborts       map[int]bool
+	recvBytes        uint32
+	recvAckBytes     uint32
+	recvAckWindow    uint32
+	sendBytes        uint32
+	sendAckBytes     uint32
+	sendAckWindow    uint32
+	peerBandwidth    uint32
+	peerLimitType    byte
+	bufferLengths    map[uint32]uint32
+	bufferLock       sync.Mutex
+	handshake        HandShakeBuf
+	handshakeC0      bool
+	handshakeC2      atomic.Bool
+	handshakeStrict  bool
+	isClient         bool
+	rtmpeEnabled     bool
+	rtmpe            *rtmpeConn
+	connected        atomic.Bool
+	startTime        time.Time
+	handshakeTime    time.Time
+	readPhase        string
+	handshakeTimeout time.Duration
+	connectTimeout   time.Duration
+	idleTimeout      time.Duration
+	writeTimeout     time.Duration
+	closed           atomic.Bool
+	dataLock         sync.Mutex
+	errLock          sync.Mutex
+	err              error
+	reader           *bufio.Reader
+	readBuf          []byte
+	readLock         sync.Mutex
+	pullMode         atomic.Bool
+	messages         []*RtmpMessage
+	invokeHandler    InvokeProc
+	chunkStreamId    int
+	connId           uint64
+	baseLogger       *slog.Logger
+	logger           atomic.Pointer[slog.Logger]
+	streamName       string
+	objectEncoding   int
 }
 
 func (c *RtmpConn) Init(chunkSize int, conn net.Conn, invokeHandler InvokeProc) {
 	c.handshakeC0 = false
-	c.handshakeC2 = false
+	c.handshakeC2.Store(false)
+	c.isClient = false
+	c.rtmpe = nil
+	c.connected.Store(false)
+	c.startTime = time.Now()
+	c.readPhase = TIMEOUT_HANDSHAKE
+	c.closed.Store(false)
 	c.conn = conn
+	c.aryData = nil
+	c.recvBuf = nil
+	c.recvNeed = 0
+	c.maxMessageSize = RTMP_DEFAULT_MAX_MESSAGE_SIZE
+	c.maxPendingSize = RTMP_DEFAULT_MAX_PENDING_SIZE
+	c.pendingSize = 0
+	c.reader = bufio.NewReader(conn)
+	c.pullMode.Store(false)
+	c.messages = nil
+	c.err = nil
 	c.chunkSize = chunkSize
+	c.recvChunkSize = RTMP_DEFAULT_CHUNK_SIZE
+	c.sendChunkSize = RTMP_DEFAULT_CHUNK_SIZE
+	c.chunkStreams = make(map[int]*RtmpChunkStream)
+	c.sendStreams = make(map[int]*RtmpChunkStream)
+	c.sendInFlight = make(map[int]int)
+	c.sendAborts = make(map[int]bool)
+	c.recvBytes = 0
+	c.recvAckBytes = 0
+	c.recvAckWindow = 0
+	c.sendBytes = 0
+	c.sendAckBytes = 0
+	c.sendAckWindow = 0
+	c.peerBandwidth = 0
+	// With no limit in effect yet the first dynamic limit is taken as hard.
+	c.peerLimitType = RTMP_LIMIT_HARD
+	c.bufferLengths = make(map[uint32]uint32)
 	c.invokeHandler = invokeHandler
+	c.connId = nextConnId()
+	c.streamName = ""
+	c.objectEncoding = 0
+	c.SetLogger(nil)
+}
+
+// SetLogger sets the logger for this connection. Records carry the
+// connection ID and remote address, and the stream name once a publish or
+// play command named one. A nil logger discards everything.
+func (c *RtmpConn) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = discardLogger
+	}
+
+	remoteAddr := ""
+	if c.conn != nil && c.conn.RemoteAddr() != nil {
+		remoteAddr = c.conn.RemoteAddr().String()
+	}
+
+	c.baseLogger = logger.With("conn_id", c.connId, "remote_addr", remoteAddr)
+	c.updateLogger()
+}
+
+func (c *RtmpConn) updateLogger() {
+	logger := c.baseLogger
+	if c.streamName != "" {
+		logger = logger.With("stream", c.streamName)
+	}
+
+	c.logger.Store(logger)
+}
+
+func (c *RtmpConn) GetLogger() *slog.Logger {
+	return c.logger.Load()
+}
+
+func (c *RtmpConn) GetConnId() uint64 {
+	return c.connId
+}
+
+// SetStreamName attaches name to the connection's log records. It is done
+// for the stream named by publish and play commands.
+func (c *RtmpConn) SetStreamName(name string) {
+	c.streamName = name
+	c.updateLogger()
+}
+
+func (c *RtmpConn) GetStreamName() string {
+	return c.streamName
 }
 
 func (c *RtmpConn) OnRecv(b []byte, dataLen int) {
@@ -35,220 +167,1125 @@ func (c *RtmpConn) OnRecv(b []byte, dataLen int) {
 
 	defer c.dataLock.Unlock()
 
-	c.aryData = append(c.aryData, b[:dataLen]...)
+	if c.closed.Load() {
+		return
+	}
 
-	if !c.handshakeC0 {
-		if len(c.aryData) < 1537 {
-			return
-		}
+	recvStart := len(c.aryData)
+	c.appendRecv(b[:dataLen])
 
-		c.handshakeC0 = true
-		if !c.ProcessHandshake() {
-			fmt.Println("Processhandshake eror!")
-			return
-		}
+	defer c.updateReadDeadline()
+	defer c.shrinkRecv()
 
-		if len(c.aryData) > 1537 {
-			c.aryData = c.aryData[1537:]
+	if c.rtmpe != nil {
+		c.rtmpe.Decrypt(c.aryData[recvStart:])
+	}
+
+	if !c.handshakeC2.Load() {
+		var done bool
+		var err error
+		if c.isClient {
+			done, err = c.processClientHandshake()
 		} else {
-			c.aryData = make([]byte, 0)
+			done, err = c.processServerHandshake()
 		}
 
-	} else if !c.handshakeC2 {
-		if len(c.aryData) < 1536 {
+		if err != nil {
+			c.OnError(err)
+			c.Close()
 			return
 		}
 
-		c.handshakeC2 = true
+		if !done {
+			return
+		}
 
-		if len(c.aryData) > 1536 {
-			c.aryData = c.aryData[1536:]
-		} else {
-			c.aryData = make([]byte, 0)
+		if c.handshake.IsEncrypted() {
+			if err := c.startEncryption(); err != nil {
+				c.OnError(err)
+				c.Close()
+				return
+			}
 		}
+
+		c.handshakeTime = time.Now()
+		c.handshakeC2.Store(true)
+		c.GetLogger().Debug("handshake done", "encrypted", c.rtmpe != nil, "complex", c.handshake.IsComplex())
 	}
 
 	if len(c.aryData) > 0 {
 
-		for {
-			packet, ret := c.DecodePacket()
-			if ret {
+		// Wait for the chunk to be whole before parsing its header again.
+		for len(c.aryData) >= c.recvNeed {
+			packet, err := c.DecodePacket()
+			if errors.Is(err, ErrShortBuffer) {
+				c.recvNeed = packet.GetPacketLen()
+				break
+			}
+			c.recvNeed = 0
 
-				c.ProcessPacket(packet)
+			if err == nil {
+				logger := c.GetLogger()
+				if logger.Enabled(context.Background(), LevelTrace) {
+					logger.Log(context.Background(), LevelTrace, "chunk", "csid", packet.GetChunkStreamId(), "type", packet.GetPacketType(),
+						"stream_id", packet.GetStreamId(), "timestamp", packet.GetTimeStamp(), "size", packet.GetBodySize(),
+						"chunk_len", packet.GetPacketLen(), "complete", packet.IsComplete())
+				}
 
 				packetLen := packet.GetPacketLen()
 				c.aryData = c.aryData[packetLen:]
+				c.recvBytes += uint32(packetLen)
 
-			} else {
-				break
+				if packet.IsComplete() {
+					err = c.ProcessPacket(packet)
+
+					// Bodies of queued messages now belong to ReadMessage.
+					if !c.isQueued(packet.GetPacketType()) {
+						putBody(packet.GetBodyData())
+					}
+				}
+			}
+
+			// Anything but running out of data is a protocol violation the
+			// connection can not recover from. A failed write has already
+			// closed it and reported why.
+			if err != nil {
+				if !c.closed.Load() {
+					c.OnError(err)
+					c.Close()
+				}
+				return
+			}
+		}
+
+		// The sequence number wraps at 32 bits like the counter itself.
+		if c.recvAckWindow > 0 && c.recvBytes-c.recvAckBytes >= c.recvAckWindow {
+			if err := c.SendAcknowledgement(c.recvBytes); err == nil {
+				c.recvAckBytes = c.recvBytes
 			}
 		}
 	}
 }
 
-func (c *RtmpConn) ProcessPacket(p RtmpPacket) {
+// ProcessPacket acts on a whole message. An error means the message broke
+// the protocol or answering it failed.
+func (c *RtmpConn) ProcessPacket(p RtmpPacket) error {
 
 	c.chunkStreamId = p.GetChunkStreamId()
 	packetType := p.GetPacketType()
+
+	if c.isQueued(packetType) {
+		if packetType == AMF_TYPE_INVOKE || packetType == AMF_TYPE_INVOKE_AMF3 {
+			bodyData := amfPayload(packetType, p.GetBodyData())
+			var amfCommand Amf0
+			strCommand := amfCommand.GetCommand(bodyData)
+			c.updateConnected(strCommand)
+			if strCommand == "publish" || strCommand == "play" || strCommand == "connect" {
+				// The stream name and object encoding are only noted
+				// here; a payload that does not decode is left to the
+				// caller of ReadMessage.
+				var amf Amf0
+				if amfData, err := amf.ReadData(bodyData, false); err == nil {
+					c.updateStreamName(strCommand, amfData)
+					c.updateObjectEncoding(strCommand, amfData)
+				}
+			}
+		}
+		c.messages = append(c.messages, newRtmpMessage(p))
+		return nil
+	}
+
 	switch packetType {
 	case AMF_SET_CHUNKSIZE:
-	case AMF_STREAM_BEGIN:
+		return c.ProcessSetChunkSize(p)
+	case AMF_ABORT:
+		return c.ProcessAbort(p)
+	case AMF_USER_CONTROL:
+		return c.ProcessUserControl(p)
+	case AMF_ACK:
+		return c.ProcessAck(p)
 	case AMF_ACK_SIZE:
-		c.ProcessAckSize()
+		return c.ProcessAckSize(p)
 	case AMF_BAND_WIDTH:
+		return c.ProcessPeerBandwidth(p)
 	case AMF_TYPE_AUDIO:
 	case AMF_TYPE_VIDEO:
-	case AMF_TYPE_NOTIFY:
-	case AMF_TYPE_INVOKE:
-		c.ProcessInvoke(p)
+	case AMF_TYPE_NOTIFY, AMF_TYPE_NOTIFY_AMF3:
+	case AMF_TYPE_INVOKE, AMF_TYPE_INVOKE_AMF3:
+		return c.ProcessInvoke(p)
 	}
 
+	return nil
 }
 
-func (c *RtmpConn) ProcessAckSize() {
-	fmt.Printf("Process acknowledgement size\n")
+func (c *RtmpConn) ProcessSetChunkSize(p RtmpPacket) error {
+	bodyData := p.GetBodyData()
+	if len(bodyData) < 4 {
+		return fmt.Errorf("%w: set chunk size message too short (%d bytes)", ErrMalformedMessage, len(bodyData))
+	}
+
+	// The first bit of the payload must be zero, leaving 31 bits of size.
+	chunkSize := binary.BigEndian.Uint32(bodyData)
+	if chunkSize&0x80000000 != 0 || chunkSize == 0 {
+		return fmt.Errorf("%w: chunk size %d", ErrMalformedMessage, chunkSize)
+	}
+
+	c.recvChunkSize = int(chunkSize)
+	c.GetLogger().Debug("peer set chunk size", "size", chunkSize)
+
+	return nil
 }
 
-func (c *RtmpConn) ProcessInvoke(p RtmpPacket) {
+// ProcessAbort discards whatever part of a message the peer had sent on the
+// chunk stream named in the payload.
+func (c *RtmpConn) ProcessAbort(p RtmpPacket) error {
+	bodyData := p.GetBodyData()
+	if len(bodyData) < 4 {
+		return fmt.Errorf("%w: abort message too short (%d bytes)", ErrMalformedMessage, len(bodyData))
+	}
+
+	chunkStreamId := int(binary.BigEndian.Uint32(bodyData))
+	if cs, ok := c.chunkStreams[chunkStreamId]; ok {
+		c.pendingSize -= len(cs.bodyData)
+		putBody(cs.bodyData)
+		cs.Abort()
+	}
+
+	return nil
+}
+
+func (c *RtmpConn) ProcessUserControl(p RtmpPacket) error {
+	var event UserControlEvent
+	if err := event.Decode(p.GetBodyData()); err != nil {
+		return err
+	}
+
+	switch event.EventType {
+	case USER_CONTROL_PING_REQUEST:
+		if err := c.SendPingResponse(event.TimeStamp); err != nil {
+			return err
+		}
+	case USER_CONTROL_SET_BUFFER_LENGTH:
+		// Stream IDs come from the peer, so only so many are kept.
+		c.bufferLock.Lock()
+		if _, ok := c.bufferLengths[event.StreamId]; ok || len(c.bufferLengths) < RTMP_MAX_BUFFER_LENGTHS {
+			c.bufferLengths[event.StreamId] = event.BufferLength
+		}
+		c.bufferLock.Unlock()
+	}
+
+	if handler, ok := c.invokeHandler.(UserControlProc); ok {
+		handler.OnUserControl(event, c)
+	}
+
+	return nil
+}
+
+// GetBufferLength returns the buffer length in milliseconds the client last
+// set for streamId, or 0 if it never did. Only the first
+// RTMP_MAX_BUFFER_LENGTHS streams the client sets one for are remembered.
+// It may be called from any goroutine.
+func (c *RtmpConn) GetBufferLength(streamId uint32) uint32 {
+	c.bufferLock.Lock()
+	defer c.bufferLock.Unlock()
+
+	return c.bufferLengths[streamId]
+}
+
+func (c *RtmpConn) ProcessAck(p RtmpPacket) error {
+	bodyData := p.GetBodyData()
+	if len(bodyData) < 4 {
+		return fmt.Errorf("%w: acknowledgement message too short (%d bytes)", ErrMalformedMessage, len(bodyData))
+	}
+
+	c.sendAckBytes = binary.BigEndian.Uint32(bodyData)
+
+	return nil
+}
+
+// ProcessAckSize records the peer's window, after which we owe it an
+// Acknowledgement carrying the number of bytes received so far.
+func (c *RtmpConn) ProcessAckSize(p RtmpPacket) error {
+	bodyData := p.GetBodyData()
+	if len(bodyData) < 4 {
+		return fmt.Errorf("%w: window acknowledgement size message too short (%d bytes)", ErrMalformedMessage, len(bodyData))
+	}
+
+	c.recvAckWindow = binary.BigEndian.Uint32(bodyData)
+
+	return nil
+}
+
+// ProcessPeerBandwidth applies the peer's output limit according to its
+// limit type and answers with our new window if it changed. The limit is
+// only recorded, for GetPeerBandwidth.
+func (c *RtmpConn) ProcessPeerBandwidth(p RtmpPacket) error {
+	bodyData := p.GetBodyData()
+	if len(bodyData) < 5 {
+		return fmt.Errorf("%w: set peer bandwidth message too short (%d bytes)", ErrMalformedMessage, len(bodyData))
+	}
+
+	bandwidthSize := binary.BigEndian.Uint32(bodyData)
+	limitType := bodyData[4]
+
+	// A dynamic limit acts as hard if the previous limit was hard and is
+	// ignored otherwise.
+	if limitType == RTMP_LIMIT_DYNAMIC {
+		if c.peerLimitType != RTMP_LIMIT_HARD {
+			return nil
+		}
+		limitType = RTMP_LIMIT_HARD
+	}
+
+	switch limitType {
+	case RTMP_LIMIT_HARD:
+		c.peerBandwidth = bandwidthSize
+	case RTMP_LIMIT_SOFT:
+		if c.peerBandwidth == 0 || bandwidthSize < c.peerBandwidth {
+			c.peerBandwidth = bandwidthSize
+		}
+	default:
+		return fmt.Errorf("%w: peer bandwidth limit type %d", ErrMalformedMessage, limitType)
+	}
+
+	c.peerLimitType = limitType
+	c.GetLogger().Debug("peer set bandwidth", "size", c.peerBandwidth, "limit_type", limitType)
+
+	if c.peerBandwidth != c.sendAckWindow {
+		return c.SendAckSize(c.peerBandwidth)
+	}
+
+	return nil
+}
+
+func (c *RtmpConn) ProcessInvoke(p RtmpPacket) error {
+	bodyData := amfPayload(p.GetPacketType(), p.GetBodyData())
+
 	var amfCommand Amf0
-	strCommand := amfCommand.GetCommand(p.GetBodyData())
+	strCommand := amfCommand.GetCommand(bodyData)
 	if strCommand == "" {
-		fmt.Printf("Command error!\n")
-		return
+		return fmt.Errorf("%w: command message without a command name", ErrAMFDecode)
 	}
 
 	var amf Amf0
-	amfData := amf.ReadData(p.GetBodyData(), false)
+	amfData, err := amf.ReadData(bodyData, false)
+	if err != nil {
+		return fmt.Errorf("%s command: %w", strCommand, err)
+	}
+
+	c.GetLogger().Debug("command", "name", strCommand)
+	c.updateConnected(strCommand)
+	c.updateStreamName(strCommand, amfData)
+	c.updateObjectEncoding(strCommand, amfData)
 
 	switch strCommand {
 	case "connect":
-		c.SendAckSize(p.GetChunkStreamId(), 2500000)
-		c.SendSetPeerBandwidth(p.GetChunkStreamId(), 2500000)
-		c.SendControlMessage(p.GetChunkStreamId(), 0)
-		c.SendResultMsg(p)
-		c.SendOnBwDoneMsg(p)
+		if c.chunkSize != c.sendChunkSize {
+			if err := c.SendSetChunkSize(c.chunkSize); err != nil {
+				return err
+			}
+		}
+		if err := c.SendAckSize(2500000); err != nil {
+			return err
+		}
+		if err := c.SendSetPeerBandwidth(2500000, RTMP_LIMIT_DYNAMIC); err != nil {
+			return err
+		}
+		if err := c.SendStreamBegin(0); err != nil {
+			return err
+		}
+		if err := c.SendResultMsg(p); err != nil {
+			return err
+		}
+		return c.SendOnBwDoneMsg(p)
 	default:
-		c.invokeHandler.OnInvokeProc(strCommand, amfData, c)
+		if c.invokeHandler != nil {
+			c.invokeHandler.OnInvokeProc(strCommand, amfData, c)
+		}
+	}
+
+	return nil
+}
+
+// isQueued reports whether messages of packetType are left to the caller of
+// ReadMessage, which is everything but protocol control in pull mode.
+func (c *RtmpConn) isQueued(packetType int) bool {
+	return c.pullMode.Load() && !isControlMessage(packetType)
+}
+
+// appendRecv adds data to what is left of the received bytes. The buffer is
+// reused: the unparsed rest is moved to its front rather than growing it.
+func (c *RtmpConn) appendRecv(data []byte) {
+	unread := len(c.aryData)
+
+	if cap(c.recvBuf)-len(c.recvBuf) < len(data) {
+		if cap(c.recvBuf) < unread+len(data) {
+			recvBuf := make([]byte, unread, 2*(unread+len(data)))
+			copy(recvBuf, c.aryData)
+			c.recvBuf = recvBuf
+		} else {
+			copy(c.recvBuf[:unread], c.aryData)
+			c.recvBuf = c.recvBuf[:unread]
+		}
+	}
+
+	c.recvBuf = append(c.recvBuf, data...)
+	c.aryData = c.recvBuf[len(c.recvBuf)-unread-len(data):]
+}
+
+// shrinkRecv lets go of a receive buffer a large chunk made grow once it is
+// empty again.
+func (c *RtmpConn) shrinkRecv() {
+	if len(c.aryData) > 0 {
+		return
+	}
+
+	if cap(c.recvBuf) > 2*bodyInitialSize {
+		c.recvBuf = nil
+	} else {
+		c.recvBuf = c.recvBuf[:0]
+	}
+	c.aryData = c.recvBuf
+}
+
+// SetMaxMessageSize sets the largest message the peer may send. A larger one
+// fails the connection with ErrMessageTooLarge.
+func (c *RtmpConn) SetMaxMessageSize(size int) {
+	c.maxMessageSize = size
+}
+
+// SetMaxPendingSize limits the bytes held for messages the peer has started
+// on several chunk streams but not finished yet.
+func (c *RtmpConn) SetMaxPendingSize(size int) {
+	c.maxPendingSize = size
+}
+
+// updateConnected marks a server connected once the client sends connect,
+// and a client once the server answers it.
+func (c *RtmpConn) updateConnected(strCommand string) {
+	if c.isClient {
+		if strCommand != "_result" && strCommand != "_error" {
+			return
+		}
+	} else if strCommand != "connect" {
+		return
+	}
+
+	if c.connected.CompareAndSwap(false, true) {
+		c.GetLogger().Info("connected")
+	}
+}
+
+// updateStreamName picks the stream name out of publish and play, where it
+// follows the command name, transaction ID and null.
+func (c *RtmpConn) updateStreamName(strCommand string, amfData AmfData) {
+	if strCommand != "publish" && strCommand != "play" {
+		return
+	}
+
+	if len(amfData.ObjList) > 3 && amfData.ObjList[3].DataType == AMF0_STRING {
+		c.SetStreamName(amfData.ObjList[3].StrVal)
 	}
 }
 
+// updateObjectEncoding takes the AMF version a client asks for from the
+// objectEncoding of its connect command object.
+func (c *RtmpConn) updateObjectEncoding(strCommand string, amfData AmfData) {
+	if c.isClient || strCommand != "connect" || len(amfData.ObjList) < 3 {
+		return
+	}
+
+	if objectEncoding, ok := amfData.ObjList[2].ObjMap["objectEncoding"]; ok && objectEncoding.DataType == AMF0_NUMBER && objectEncoding.NumberVal == 3 {
+		c.objectEncoding = 3
+	} else {
+		c.objectEncoding = 0
+	}
+}
+
+// GetObjectEncoding returns the AMF version the client asked for in connect,
+// 0 or 3.
+func (c *RtmpConn) GetObjectEncoding() int {
+	return c.objectEncoding
+}
+
+// OnError is called with errors that end the connection from within OnRecv
+// and OnReadError, and passes them on to the invoke handler if it implements
+// ErrorProc.
 func (c *RtmpConn) OnError(err error) {
+	c.errLock.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errLock.Unlock()
+
+	c.GetLogger().Warn("connection error", "err", err)
+
+	if handler, ok := c.invokeHandler.(ErrorProc); ok {
+		handler.OnError(err, c)
+	}
 }
 
-func (c *RtmpConn) DecodePacket() (RtmpPacket, bool) {
+// Err returns the first error reported on the connection, if any.
+func (c *RtmpConn) Err() error {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+
+	return c.err
+}
+
+// DecodePacket decodes the next chunk of the received data. It returns
+// ErrShortBuffer until the whole chunk is there, and ErrMessageTooLarge as
+// soon as the header shows the message would break the size limits.
+func (c *RtmpConn) DecodePacket() (RtmpPacket, error) {
 	var packet RtmpPacket
-	ret := packet.Decode(c.aryData, len(c.aryData), c.chunkSize, c.preBodySize, c.preTimeStamp, c.prePacketType)
-	if !ret {
-		//fmt.Printf("Decode packet error.")
-		return packet, false
+	_, chunkStreamId, _, err := packet.DecodeBasicHeader(c.aryData, len(c.aryData))
+	if err != nil {
+		return packet, err
 	}
 
-	c.preBodySize = packet.GetBodySize()
-	c.preTimeStamp = packet.GetTimeStamp()
-	c.prePacketType = packet.GetPacketType()
+	cs := c.GetChunkStream(chunkStreamId)
+	received := len(cs.bodyData)
+	err = packet.Decode(c.aryData, len(c.aryData), c.recvChunkSize, cs)
 
-	return packet, true
-}
+	if c.maxMessageSize > 0 && packet.GetBodySize() > c.maxMessageSize {
+		return packet, fmt.Errorf("%w: %d bytes on chunk stream %d", ErrMessageTooLarge, packet.GetBodySize(), chunkStreamId)
+	}
 
-func (c *RtmpConn) ProcessHandshake() bool {
-	if c.aryData[0] != 3 {
-		return false
+	if err != nil {
+		return packet, err
 	}
 
-	c.SendHandshakeS0S1S2()
+	// A new message drops whatever was left of an unfinished one.
+	c.pendingSize -= received
+	if !packet.IsComplete() {
+		c.pendingSize += len(cs.bodyData)
+	}
 
-	return true
+	if c.maxPendingSize > 0 && c.pendingSize > c.maxPendingSize {
+		return packet, fmt.Errorf("%w: %d bytes pending", ErrMessageTooLarge, c.pendingSize)
+	}
+
+	return packet, nil
 }
 
-func (c *RtmpConn) SendHandshakeC0C1() bool {
+func (c *RtmpConn) GetChunkStream(chunkStreamId int) *RtmpChunkStream {
+	cs, ok := c.chunkStreams[chunkStreamId]
+	if !ok {
+		cs = new(RtmpChunkStream)
+		cs.Init(chunkStreamId)
+		c.chunkStreams[chunkStreamId] = cs
+	}
 
-	handshakeData := make([]byte, 1537)
-	handshakeData[0] = 0x03
+	return cs
+}
 
-	ts := time.Now()
+// processServerHandshake consumes C0+C1 and then C2 as they become
+// available, and reports whether the handshake is complete.
+func (c *RtmpConn) processServerHandshake() (bool, error) {
+	if !c.handshakeC0 {
+		if len(c.aryData) < 1+HANDSHAKE_SIZE {
+			return false, nil
+		}
 
-	tsBuf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(tsBuf, uint64(ts.Unix()))
+		if err := c.ProcessHandshake(); err != nil {
+			return false, err
+		}
 
-	for i := 0; i < 8; i++ {
-		//fmt.Printf("%02X", tsBuf[i])
-		handshakeData[i+1] = tsBuf[i]
+		c.handshakeC0 = true
+		c.aryData = c.aryData[1+HANDSHAKE_SIZE:]
 	}
 
-	for i := 9; i < 1537; i++ {
-		handshakeData[i] = byte(rand.Intn(256))
+	// C2 may arrive in the same read as C0+C1.
+	if len(c.aryData) < HANDSHAKE_SIZE {
+		return false, nil
 	}
 
-	return true
+	if err := c.ProcessHandshakeC2(); err != nil {
+		return false, err
+	}
+
+	c.aryData = c.aryData[HANDSHAKE_SIZE:]
+
+	return true, nil
 }
 
-func (c *RtmpConn) SendHandshakeS0S1S2() bool {
+// processClientHandshake waits for S0+S1+S2 in reply to the C0+C1 sent by
+// SendHandshakeC0C1, answers with C2 and reports whether the handshake is
+// complete.
+func (c *RtmpConn) processClientHandshake() (bool, error) {
+	if !c.handshakeC0 {
+		return false, fmt.Errorf("%w: data received before C0+C1 was sent", ErrHandshake)
+	}
 
-	var hb HandShakeBuf
-	hb.InitBuf()
+	if len(c.aryData) < 1+HANDSHAKE_SIZE*2 {
+		return false, nil
+	}
+
+	if err := c.ProcessHandshakeS0S1S2(); err != nil {
+		return false, err
+	}
 
-	n, err := c.conn.Write(hb.GetBuf())
+	c.aryData = c.aryData[1+HANDSHAKE_SIZE*2:]
 
+	return true, nil
+}
+
+// startEncryption switches to RC4 once an RTMPE handshake is complete.
+// Whatever followed the handshake in the last read is already encrypted.
+func (c *RtmpConn) startEncryption() error {
+	rtmpe, err := c.handshake.NewEncryptedConn(c.conn)
 	if err != nil {
-		fmt.Println("write s0s1s2 error!")
-		return false
+		return err
 	}
 
-	fmt.Printf("write s0s1s2 OK. n=%d\n", n)
+	rtmpe.Decrypt(c.aryData)
 
-	return true
+	c.sendLock.Lock()
+	c.rtmpe = rtmpe
+	c.conn = rtmpe
+	c.sendLock.Unlock()
+
+	return nil
 }
 
-func (c *RtmpConn) SendAckSize(chunkStreamId byte, ackSize uint32) bool {
-	var packet RtmpPacket
-	ackData := packet.AckPacket(chunkStreamId, ackSize)
-	_, err := c.conn.Write(ackData)
-	if err != nil {
-		fmt.Println("write s0s1s2 error!")
-		return false
+// SetRtmpe makes SendHandshakeC0C1 start an RTMPE handshake. Servers accept
+// RTMPE whenever a client asks for it.
+func (c *RtmpConn) SetRtmpe(enable bool) {
+	c.rtmpeEnabled = enable
+}
+
+func (c *RtmpConn) IsEncrypted() bool {
+	return c.rtmpe != nil
+}
+
+func (c *RtmpConn) ProcessHandshake() error {
+	if c.aryData[0] != RTMP_VERSION && c.aryData[0] != RTMPE_VERSION {
+		return fmt.Errorf("%w: unsupported version %d", ErrHandshake, c.aryData[0])
 	}
 
-	return true
+	return c.SendHandshakeS0S1S2(c.aryData[:1537])
 }
 
-func (c *RtmpConn) SendSetPeerBandwidth(chunkStreamId byte, bandwidthSize uint32) bool {
-	var packet RtmpPacket
-	bnadwidthData := packet.SetPeerBandwidthPacket(chunkStreamId, bandwidthSize)
-	_, err := c.conn.Write(bnadwidthData)
+// ProcessHandshakeS0S1S2 checks the server's reply and sends C2. As with C2
+// on the server side, digest and echo mismatches only fail the handshake in
+// strict mode and are otherwise logged as warnings.
+func (c *RtmpConn) ProcessHandshakeS0S1S2() error {
+	if c.aryData[0] != c.handshake.GetBuf()[0] {
+		return fmt.Errorf("%w: unsupported version %d", ErrHandshake, c.aryData[0])
+	}
+
+	s1 := c.aryData[1 : 1+HANDSHAKE_SIZE]
+	s2 := c.aryData[1+HANDSHAKE_SIZE : 1+HANDSHAKE_SIZE*2]
+
+	// Without the key exchange there is nothing to fall back to, so RTMPE
+	// fails regardless of strict mode.
+	if err := c.handshake.ProcessS1Keys(s1); err != nil {
+		return err
+	}
+
+	var err error
+	if !c.handshake.ValidateS1(s1) {
+		err = fmt.Errorf("%w: S1 digest is invalid", ErrHandshake)
+	} else if !c.handshake.ValidateS2(s2) {
+		err = fmt.Errorf("%w: S2 does not match C1", ErrHandshake)
+	}
+
 	if err != nil {
-		fmt.Println("write s0s1s2 error!")
-		return false
+		if c.handshakeStrict {
+			return err
+		}
+		c.GetLogger().Warn("accepting handshake", "err", err)
 	}
 
-	return true
+	_, err = c.write(c.handshake.BuildC2(s1))
+	if err != nil {
+		return fmt.Errorf("%w: write c2: %w", ErrHandshake, err)
+	}
+
+	return nil
 }
 
-func (c *RtmpConn) SendControlMessage(chunkStreamId byte, eventType uint16) bool {
-	var packet RtmpPacket
-	controlMsgData := packet.ControlMessagePacket(chunkStreamId, eventType)
-	_, err := c.conn.Write(controlMsgData)
+// ProcessHandshakeC2 checks that C2 answers our S1. In lenient mode, the
+// default, a mismatch is only logged as a warning, since a number of
+// encoders send a C2 that does not echo S1.
+func (c *RtmpConn) ProcessHandshakeC2() error {
+	if c.handshake.ValidateC2(c.aryData[:1536]) {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: C2 does not match S1", ErrHandshake)
+	if c.handshakeStrict {
+		return err
+	}
+
+	c.GetLogger().Warn("accepting handshake", "err", err)
+
+	return nil
+}
+
+// SetHandshakeStrict makes a C2 that does not match S1 fail the handshake,
+// and for a client an S1 or S2 that does not verify.
+func (c *RtmpConn) SetHandshakeStrict(strict bool) {
+	c.handshakeStrict = strict
+}
+
+// SetHandshakeTimeout limits the time from Init to the end of the handshake.
+func (c *RtmpConn) SetHandshakeTimeout(d time.Duration) {
+	c.handshakeTimeout = d
+	c.updateReadDeadline()
+}
+
+// SetConnectTimeout limits the time from the end of the handshake to the
+// connect command, or for a client to the server's answer to it.
+func (c *RtmpConn) SetConnectTimeout(d time.Duration) {
+	c.connectTimeout = d
+	c.updateReadDeadline()
+}
+
+// SetIdleTimeout limits the time the peer may go without sending anything.
+func (c *RtmpConn) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+	c.updateReadDeadline()
+}
+
+// SetWriteTimeout limits the time a single write to the connection may take.
+func (c *RtmpConn) SetWriteTimeout(d time.Duration) {
+	c.writeTimeout = d
+}
+
+// updateReadDeadline sets the read deadline to the earliest of the idle
+// deadline and the end of the current handshake or connect phase, and
+// remembers which one it is so an expiry can be reported as such.
+func (c *RtmpConn) updateReadDeadline() {
+	if c.conn == nil || c.closed.Load() {
+		return
+	}
+
+	var deadline time.Time
+	c.readPhase = TIMEOUT_IDLE
+	if c.idleTimeout > 0 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+
+	phase := ""
+	var phaseDeadline time.Time
+	if !c.handshakeC2.Load() && c.handshakeTimeout > 0 {
+		phase = TIMEOUT_HANDSHAKE
+		phaseDeadline = c.startTime.Add(c.handshakeTimeout)
+	} else if c.handshakeC2.Load() && !c.connected.Load() && c.connectTimeout > 0 {
+		phase = TIMEOUT_CONNECT
+		phaseDeadline = c.handshakeTime.Add(c.connectTimeout)
+	}
+
+	if phase != "" && (deadline.IsZero() || phaseDeadline.Before(deadline)) {
+		deadline = phaseDeadline
+		c.readPhase = phase
+	}
+
+	c.conn.SetReadDeadline(deadline)
+}
+
+// OnReadError is called by the read loop feeding OnRecv when reading from
+// the connection fails. An expired read deadline is reported to OnError as a
+// *TimeoutError for the phase it guarded, other errors as they are, except
+// for the peer closing the connection. The connection is closed either way.
+func (c *RtmpConn) OnReadError(err error) {
+	c.dataLock.Lock()
+	defer c.dataLock.Unlock()
+
+	if c.closed.Load() {
+		return
+	}
+
+	if isTimeout(err) {
+		c.OnError(&TimeoutError{Phase: c.readPhase, Err: err})
+	} else if !errors.Is(err, io.EOF) {
+		c.OnError(err)
+	}
+
+	c.Close()
+}
+
+// write writes b under the write timeout, turning an expired deadline into
+// a *TimeoutError.
+func (c *RtmpConn) write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	n, err := c.conn.Write(b)
+	if err != nil && isTimeout(err) {
+		err = &TimeoutError{Phase: TIMEOUT_WRITE, Err: err}
+	}
+
+	return n, err
+}
+
+func (c *RtmpConn) IsClosed() bool {
+	return c.closed.Load()
+}
+
+func (c *RtmpConn) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// Close closes the underlying connection and stops processing received data.
+func (c *RtmpConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	c.GetLogger().Debug("connection closed")
+
+	return c.conn.Close()
+}
+
+// SendHandshakeC0C1 puts the connection in client mode and starts the
+// handshake. The reply is consumed by OnRecv, which sends C2 and then moves
+// on to the chunk layer.
+func (c *RtmpConn) SendHandshakeC0C1() error {
+
+	c.dataLock.Lock()
+	defer c.dataLock.Unlock()
+
+	c.isClient = true
+	if err := c.handshake.InitClientBuf(true, HANDSHAKE_SCHEMA_1, c.rtmpeEnabled); err != nil {
+		return err
+	}
+
+	_, err := c.write(c.handshake.GetBuf())
 	if err != nil {
-		fmt.Println("write conctrol message error!")
+		return fmt.Errorf("%w: write c0c1: %w", ErrHandshake, err)
+	}
+
+	c.handshakeC0 = true
+
+	return nil
+}
+
+func (c *RtmpConn) IsClient() bool {
+	return c.isClient
+}
+
+func (c *RtmpConn) IsHandshakeDone() bool {
+	return c.handshakeC2.Load()
+}
+
+// SendHandshakeS0S1S2 answers C0+C1, with the digest handshake if C1 used it.
+func (c *RtmpConn) SendHandshakeS0S1S2(c0c1 []byte) error {
+
+	if err := c.handshake.InitBuf(c0c1); err != nil {
+		return err
+	}
+
+	if _, err := c.write(c.handshake.GetBuf()); err != nil {
+		return fmt.Errorf("%w: write s0s1s2: %w", ErrHandshake, err)
+	}
+
+	return nil
+}
+
+// SendPacket writes one message on the given chunk stream, leaving out as
+// much of the chunk header as the last message sent there allows. A body
+// longer than RTMP_MAX_MESSAGE_LENGTH is refused with ErrMessageTooLarge. A
+// failed write closes the connection and is also passed to OnError.
+func (c *RtmpConn) SendPacket(chunkStreamId int, streamId uint32, packetType int, timeStamp uint32, bodyData []byte) error {
+	if !isValidChunkStreamId(chunkStreamId) {
+		return fmt.Errorf("%w: %d", ErrInvalidChunkStream, chunkStreamId)
+	}
+
+	if len(bodyData) > RTMP_MAX_MESSAGE_LENGTH {
+		return fmt.Errorf("%w: %d bytes to send", ErrMessageTooLarge, len(bodyData))
+	}
+
+	// A message can be cut short from the moment it waits for its turn to
+	// be written.
+	if c.beginSend(chunkStreamId, len(bodyData)) {
+		defer c.endSend(chunkStreamId)
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	return c.writePacket(chunkStreamId, streamId, packetType, timeStamp, bodyData)
+}
+
+// beginSend counts a message as in flight on its chunk stream if it takes
+// more than one chunk, the only kind AbortMessage can cut, and reports
+// whether it did.
+func (c *RtmpConn) beginSend(chunkStreamId int, bodySize int) bool {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+
+	if bodySize <= c.sendChunkSize {
 		return false
 	}
 
+	c.sendInFlight[chunkStreamId]++
+
 	return true
 }
 
-func (c *RtmpConn) SendInvokeMessage(headerType byte, timeStamp int, bodyData []byte) bool {
+func (c *RtmpConn) endSend(chunkStreamId int) {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+
+	c.sendInFlight[chunkStreamId]--
+	if c.sendInFlight[chunkStreamId] == 0 {
+		delete(c.sendInFlight, chunkStreamId)
+		delete(c.sendAborts, chunkStreamId)
+	}
+}
+
+func (c *RtmpConn) writePacket(chunkStreamId int, streamId uint32, packetType int, timeStamp uint32, bodyData []byte) error {
+	if c.closed.Load() {
+		return ErrConnClosed
+	}
+
 	var packet RtmpPacket
-	invokeData := packet.InvokeMessage(headerType, c.chunkStreamId, timeStamp, bodyData, c.chunkSize)
+	packet.Init(chunkStreamId, streamId, packetType, timeStamp, bodyData)
 
-	_, err := c.conn.Write(invokeData)
-	if err != nil {
-		fmt.Println("write invoke message error!")
+	cs := c.GetSendChunkStream(chunkStreamId)
+	packetData := packet.Encode(c.sendChunkSize, cs)
+
+	// The message goes out in one write unless AbortMessage asked for it
+	// to be cut short, in which case only its first chunk is written: the
+	// header state of the chunk stream already counts it as sent.
+	chunkEnds := packet.GetChunkEnds()
+	aborted := c.takeSendAbort(chunkStreamId)
+	if !aborted {
+		chunkEnds = chunkEnds[len(chunkEnds)-1:]
+	}
+
+	start := 0
+	for _, end := range chunkEnds {
+		if start > 0 && aborted {
+			// Always follow an abort with a full header.
+			cs.hasHeader = false
+
+			abortAry := make([]byte, 4)
+			binary.BigEndian.PutUint32(abortAry, uint32(chunkStreamId))
+			if err := c.writePacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_ABORT, 0, abortAry); err != nil {
+				return err
+			}
+			return ErrAborted
+		}
+
+		n, err := c.write(packetData[start:end])
+		c.sendBytes += uint32(n)
+		if err != nil {
+			// The peer would see a broken message, so the connection can
+			// not be used any more.
+			c.OnError(err)
+			c.Close()
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// takeSendAbort reports whether AbortMessage was called for chunkStreamId,
+// clearing the request so that it cuts one message only.
+func (c *RtmpConn) takeSendAbort(chunkStreamId int) bool {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+
+	aborted := c.sendAborts[chunkStreamId]
+	delete(c.sendAborts, chunkStreamId)
+
+	return aborted
+}
+
+// AbortMessage stops the message being sent on chunkStreamId from another
+// goroutine, e.g. to drop a video frame that is already late. A message still
+// waiting for an earlier one to be written goes out with its first chunk
+// only, and the peer is told to discard the rest; one already being written
+// is written in full. It returns false if no message of more than one chunk,
+// the only kind that can be cut, was in flight on that chunk stream.
+func (c *RtmpConn) AbortMessage(chunkStreamId int) bool {
+	c.abortLock.Lock()
+	defer c.abortLock.Unlock()
+
+	if c.sendInFlight[chunkStreamId] == 0 {
 		return false
 	}
 
+	c.sendAborts[chunkStreamId] = true
+
 	return true
 }
 
-func (c *RtmpConn) SendResultMsg(p RtmpPacket) {
+func (c *RtmpConn) GetSendChunkStream(chunkStreamId int) *RtmpChunkStream {
+	cs, ok := c.sendStreams[chunkStreamId]
+	if !ok {
+		cs = new(RtmpChunkStream)
+		cs.Init(chunkStreamId)
+		c.sendStreams[chunkStreamId] = cs
+	}
+
+	return cs
+}
+
+// SendSetChunkSize announces the chunk size used for every message this side
+// sends from now on.
+func (c *RtmpConn) SendSetChunkSize(chunkSize int) error {
+	if chunkSize < 1 || chunkSize > RTMP_MAX_CHUNK_SIZE {
+		return fmt.Errorf("%w: %d", ErrInvalidChunkSize, chunkSize)
+	}
+
+	chunkSizeAry := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSizeAry, uint32(chunkSize))
+
+	// Hold the send lock until the new size is in place so that no message
+	// gets chunked with the old size after the peer has switched.
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	if err := c.writePacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_SET_CHUNKSIZE, 0, chunkSizeAry); err != nil {
+		return err
+	}
+
+	// beginSend reads the size under abortLock only.
+	c.abortLock.Lock()
+	c.sendChunkSize = chunkSize
+	c.abortLock.Unlock()
+
+	c.GetLogger().Debug("set chunk size", "size", chunkSize)
+
+	return nil
+}
+
+func (c *RtmpConn) GetRecvBytes() uint32 {
+	return c.recvBytes
+}
+
+func (c *RtmpConn) GetSendBytes() uint32 {
+	return c.sendBytes
+}
+
+// GetUnackedBytes returns how many bytes we have sent that the peer has not
+// acknowledged yet, to be weighed against GetPeerBandwidth.
+func (c *RtmpConn) GetUnackedBytes() uint32 {
+	return c.sendBytes - c.sendAckBytes
+}
+
+// GetPeerBandwidth returns how many bytes the peer lets us send without
+// acknowledging them, as set with Set Peer Bandwidth and its hard, soft and
+// dynamic rules, or 0 if it set no limit. RtmpConn does not hold back its
+// own writes to stay within it; limiting output is the caller's job, by
+// comparing GetUnackedBytes with it and dropping or delaying media until
+// the peer catches up.
+func (c *RtmpConn) GetPeerBandwidth() uint32 {
+	return c.peerBandwidth
+}
+
+func (c *RtmpConn) GetRecvChunkSize() int {
+	return c.recvChunkSize
+}
+
+func (c *RtmpConn) GetSendChunkSize() int {
+	return c.sendChunkSize
+}
+
+// SendAckSize announces the window after which the peer should acknowledge
+// the bytes it has received from us.
+func (c *RtmpConn) SendAckSize(ackSize uint32) error {
+	ackByteAry := make([]byte, 4)
+	binary.BigEndian.PutUint32(ackByteAry, ackSize)
+
+	if err := c.SendPacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_ACK_SIZE, 0, ackByteAry); err != nil {
+		return err
+	}
+
+	c.sendAckWindow = ackSize
+
+	return nil
+}
+
+func (c *RtmpConn) SendAcknowledgement(sequenceNumber uint32) error {
+	ackByteAry := make([]byte, 4)
+	binary.BigEndian.PutUint32(ackByteAry, sequenceNumber)
+
+	return c.SendPacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_ACK, 0, ackByteAry)
+}
+
+func (c *RtmpConn) SendSetPeerBandwidth(bandwidthSize uint32, limitType byte) error {
+	bandwidthAry := make([]byte, 5)
+	binary.BigEndian.PutUint32(bandwidthAry, bandwidthSize)
+	bandwidthAry[4] = limitType
+
+	return c.SendPacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_BAND_WIDTH, 0, bandwidthAry)
+}
+
+func (c *RtmpConn) SendUserControl(event UserControlEvent) error {
+	return c.SendPacket(RTMP_CONTROL_CHUNK_STREAM, 0, AMF_USER_CONTROL, 0, event.Encode())
+}
+
+func (c *RtmpConn) sendStreamEvent(eventType uint16, streamId uint32) error {
+	var event UserControlEvent
+	event.EventType = eventType
+	event.StreamId = streamId
+
+	return c.SendUserControl(event)
+}
+
+func (c *RtmpConn) SendStreamBegin(streamId uint32) error {
+	return c.sendStreamEvent(USER_CONTROL_STREAM_BEGIN, streamId)
+}
+
+func (c *RtmpConn) SendStreamEOF(streamId uint32) error {
+	return c.sendStreamEvent(USER_CONTROL_STREAM_EOF, streamId)
+}
+
+func (c *RtmpConn) SendStreamDry(streamId uint32) error {
+	return c.sendStreamEvent(USER_CONTROL_STREAM_DRY, streamId)
+}
+
+func (c *RtmpConn) SendStreamIsRecorded(streamId uint32) error {
+	return c.sendStreamEvent(USER_CONTROL_STREAM_IS_RECORDED, streamId)
+}
+
+func (c *RtmpConn) SendSetBufferLength(streamId uint32, bufferLength uint32) error {
+	var event UserControlEvent
+	event.EventType = USER_CONTROL_SET_BUFFER_LENGTH
+	event.StreamId = streamId
+	event.BufferLength = bufferLength
+
+	return c.SendUserControl(event)
+}
+
+func (c *RtmpConn) SendPingRequest(timeStamp uint32) error {
+	var event UserControlEvent
+	event.EventType = USER_CONTROL_PING_REQUEST
+	event.TimeStamp = timeStamp
+
+	return c.SendUserControl(event)
+}
+
+func (c *RtmpConn) SendPingResponse(timeStamp uint32) error {
+	var event UserControlEvent
+	event.EventType = USER_CONTROL_PING_RESPONSE
+	event.TimeStamp = timeStamp
+
+	return c.SendUserControl(event)
+}
+
+// SendInvokeMessage sends a command on the chunk stream of the last received
+// message, or on RTMP_COMMAND_CHUNK_STREAM before any. streamId is 0 for
+// NetConnection commands and the NetStream ID otherwise.
+func (c *RtmpConn) SendInvokeMessage(streamId uint32, timeStamp uint32, bodyData []byte) error {
+	chunkStreamId := c.chunkStreamId
+	if !isValidChunkStreamId(chunkStreamId) {
+		chunkStreamId = RTMP_COMMAND_CHUNK_STREAM
+	}
+
+	return c.SendPacket(chunkStreamId, streamId, AMF_TYPE_INVOKE, timeStamp, bodyData)
+}
+
+func (c *RtmpConn) SendResultMsg(p RtmpPacket) error {
 
 	var amfObj Amf0
 	amfObj.WriteString("_result")
@@ -262,7 +1299,7 @@ func (c *RtmpConn) SendResultMsg(p RtmpPacket) {
 	amfObj.WritePropertyString("level", "status")
 	amfObj.WritePropertyString("code", "NetConnection.Connect.Success")
 	amfObj.WritePropertyString("description", "Connection succeeded")
-	amfObj.WritePropertyNumber("objectEncoding", 0)
+	amfObj.WritePropertyNumber("objectEncoding", float64(c.objectEncoding))
 	amfObj.WriteObjectEnd()
 
 	/*
@@ -277,19 +1314,137 @@ func (c *RtmpConn) SendResultMsg(p RtmpPacket) {
 		//fmt.Printf("bodylen=%d, \nbodyData=:\n%02X\n", len(amfObj.GetData()), amfObj.GetData())
 	*/
 
-	c.SendInvokeMessage(byte(PACKET_FMT_12), 0, amfObj.GetData())
+	return c.sendReply(p, amfObj.GetData())
 }
 
-func (c *RtmpConn) SendOnBwDoneMsg(p RtmpPacket) {
+func (c *RtmpConn) SendOnBwDoneMsg(p RtmpPacket) error {
 	var amfObj Amf0
 	amfObj.WriteString("onBWDone")
 	amfObj.WriteNumber(0)
 	amfObj.WriteNull()
 	amfObj.WriteNumber(8192)
 
-	c.SendInvokeMessage(byte(PACKET_FMT_8), 0, amfObj.GetData())
+	return c.sendReply(p, amfObj.GetData())
+}
+
+// sendReply answers the command p with the same message type, so that a
+// command sent as AMF3 gets its answer as AMF3.
+func (c *RtmpConn) sendReply(p RtmpPacket, bodyData []byte) error {
+	if p.GetPacketType() != AMF_TYPE_INVOKE_AMF3 {
+		return c.SendInvokeMessage(p.GetStreamId(), 0, bodyData)
+	}
+
+	amf3Body := make([]byte, 0, 1+len(bodyData))
+	amf3Body = append(amf3Body, 0x00)
+	amf3Body = append(amf3Body, bodyData...)
+
+	return c.SendPacket(c.chunkStreamId, p.GetStreamId(), AMF_TYPE_INVOKE_AMF3, 0, amf3Body)
+}
+
+// Handshake reads from the connection until the handshake is complete, for
+// use with ReadMessage and WriteMessage. A client calls SendHandshakeC0C1
+// first.
+func (c *RtmpConn) Handshake() error {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	c.pullMode.Store(true)
+
+	for !c.IsHandshakeDone() {
+		if err := c.readMore(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadMessage blocks until the next whole message arrives and returns it,
+// performing the handshake first if needed. Protocol control messages are
+// handled by the connection and never returned; commands are returned
+// rather than passed to the invoke handler. Once ReadMessage has been called
+// the connection must not also be fed through OnRecv.
+func (c *RtmpConn) ReadMessage() (*RtmpMessage, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	c.pullMode.Store(true)
+
+	for {
+		c.dataLock.Lock()
+		if len(c.messages) > 0 {
+			m := c.messages[0]
+			c.messages[0] = nil
+			c.messages = c.messages[1:]
+			c.dataLock.Unlock()
+			return m, nil
+		}
+		c.dataLock.Unlock()
+
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readMore reads whatever the connection has and hands it to OnRecv.
+func (c *RtmpConn) readMore() error {
+	if c.closed.Load() {
+		return c.closeError()
+	}
+
+	if c.readBuf == nil {
+		c.readBuf = make([]byte, 4096)
+	}
+
+	n, err := c.reader.Read(c.readBuf)
+	if n > 0 {
+		c.OnRecv(c.readBuf, n)
+	}
+
+	if err != nil {
+		c.OnReadError(err)
+	}
+
+	if c.closed.Load() {
+		return c.closeError()
+	}
+
+	return nil
+}
+
+// closeError is what the pull API returns once the connection is closed: the
+// error that closed it, or io.EOF.
+func (c *RtmpConn) closeError() error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
+
+// WriteMessage sends m, picking a chunk stream from its type if it names
+// none. A Set Chunk Size message also changes the size used for sending.
+func (c *RtmpConn) WriteMessage(m *RtmpMessage) error {
+	if c.closed.Load() {
+		return c.closeError()
+	}
+
+	chunkStreamId := m.ChunkStreamId
+	if chunkStreamId < 2 {
+		chunkStreamId = defaultChunkStream(m.MessageType)
+	}
+
+	if m.MessageType == AMF_SET_CHUNKSIZE && len(m.Payload) >= 4 {
+		return c.SendSetChunkSize(int(binary.BigEndian.Uint32(m.Payload) & 0x7FFFFFFF))
+	}
+
+	return c.SendPacket(chunkStreamId, m.StreamId, m.MessageType, m.TimeStamp, m.Payload)
 }
 
+// GetConn returns the connection messages are written to. Once RTMPE is in
+// use it encrypts writes; bytes read from it are still encrypted and go to
+// OnRecv as they are.
 func (c *RtmpConn) GetConn() net.Conn {
 	return c.conn
 }
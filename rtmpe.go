@@ -0,0 +1,114 @@
+package rtmp
+
+import "crypto/rand"
+import "crypto/rc4"
+import "math/big"
+import "net"
+
+const (
+	RTMP_VERSION       = 0x03
+	RTMPE_VERSION      = 0x06
+	rtmpeDHKeyLen      = 128
+	rtmpeKeyOffsetMod  = 632
+	rtmpeRC4KeyLen     = 16
+	rtmpeKeyBlockSize  = 764
+	rtmpeKeyOffsetBase = 760
+)
+
+// rtmpeDHPrime is the 1024 bit MODP group of RFC 2409 (Oakley group 2),
+// used with generator 2 for the RTMPE key exchange.
+var rtmpeDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var rtmpeDHGenerator = big.NewInt(2)
+
+// rtmpeKeyOffset returns where the 128 byte Diffie-Hellman public key sits
+// inside a 1536 byte C1/S1. It lives in the key block, which is the other
+// block than the digest one, and is located by the four bytes closing it.
+func rtmpeKeyOffset(b []byte, schema int) int {
+	base := 8 + rtmpeKeyBlockSize
+	if schema == HANDSHAKE_SCHEMA_0 {
+		base = 8
+	}
+
+	offsetAry := b[base+rtmpeKeyOffsetBase : base+rtmpeKeyOffsetBase+4]
+	offset := int(offsetAry[0]) + int(offsetAry[1]) + int(offsetAry[2]) + int(offsetAry[3])
+
+	return base + offset%rtmpeKeyOffsetMod
+}
+
+// rtmpeGenerateKey returns a private exponent and the matching public key,
+// left padded to 128 bytes.
+func rtmpeGenerateKey() (*big.Int, []byte, error) {
+	privAry := make([]byte, rtmpeDHKeyLen)
+	if _, err := rand.Read(privAry); err != nil {
+		return nil, nil, err
+	}
+
+	priv := new(big.Int).SetBytes(privAry)
+	pub := new(big.Int).Exp(rtmpeDHGenerator, priv, rtmpeDHPrime)
+
+	return priv, pub.FillBytes(make([]byte, rtmpeDHKeyLen)), nil
+}
+
+// rtmpeSharedKey computes the shared secret, rejecting public keys outside
+// (1, p-1) which would force a predictable secret.
+func rtmpeSharedKey(priv *big.Int, peerPub []byte) ([]byte, bool) {
+	y := new(big.Int).SetBytes(peerPub)
+	max := new(big.Int).Sub(rtmpeDHPrime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, false
+	}
+
+	shared := new(big.Int).Exp(y, priv, rtmpeDHPrime)
+
+	return shared.FillBytes(make([]byte, rtmpeDHKeyLen)), true
+}
+
+// rtmpeConn encrypts everything written to the wrapped connection with the
+// RC4 keys agreed on in the handshake. Reads pass through as they are:
+// OnRecv decrypts what it is fed, whichever connection it was read from.
+type rtmpeConn struct {
+	net.Conn
+	encrypter *rc4.Cipher
+	decrypter *rc4.Cipher
+}
+
+// newRtmpeConn derives the outbound key from the peer's public key and the
+// inbound key from our own, then skips the first 1536 bytes of both key
+// streams as the peers do for the rest of the handshake.
+func newRtmpeConn(conn net.Conn, sharedKey []byte, localPub []byte, peerPub []byte) (*rtmpeConn, error) {
+	encrypter, err := rc4.NewCipher(hmacSha256(sharedKey, peerPub)[:rtmpeRC4KeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	decrypter, err := rc4.NewCipher(hmacSha256(sharedKey, localPub)[:rtmpeRC4KeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	skipAry := make([]byte, HANDSHAKE_SIZE)
+	encrypter.XORKeyStream(skipAry, skipAry)
+	decrypter.XORKeyStream(skipAry, skipAry)
+
+	return &rtmpeConn{conn, encrypter, decrypter}, nil
+}
+
+func (e *rtmpeConn) Write(b []byte) (int, error) {
+	encAry := make([]byte, len(b))
+	e.encrypter.XORKeyStream(encAry, b)
+
+	return e.Conn.Write(encAry)
+}
+
+// Decrypt decrypts in place bytes that were read from the wrapped
+// connection directly.
+func (e *rtmpeConn) Decrypt(b []byte) {
+	e.decrypter.XORKeyStream(b, b)
+}
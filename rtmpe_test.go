@@ -0,0 +1,93 @@
+package rtmp
+
+import "bytes"
+import "net"
+import "testing"
+
+func TestHandshakeLoopback(t *testing.T) {
+	t.Run("plain", func(t *testing.T) { testHandshakeLoopback(t, false) })
+	t.Run("rtmpe", func(t *testing.T) { testHandshakeLoopback(t, true) })
+}
+
+// testHandshakeLoopback connects a client to a server over loopback TCP,
+// sends connect one way and a video message the other.
+func testHandshakeLoopback(t *testing.T, rtmpe bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	video := bytes.Repeat([]byte{0x17}, 1000)
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		var server RtmpConn
+		server.Init(RTMP_DEFAULT_CHUNK_SIZE, conn, nil)
+		defer server.Close()
+
+		m, err := server.ReadMessage()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		var amf Amf0
+		if command := amf.GetCommand(m.Payload); command != "connect" {
+			t.Errorf("server read command %q, want connect", command)
+		}
+		if server.IsEncrypted() != rtmpe {
+			t.Errorf("server encrypted = %v, want %v", server.IsEncrypted(), rtmpe)
+		}
+
+		done <- server.WriteMessage(&RtmpMessage{StreamId: 1, MessageType: AMF_TYPE_VIDEO, TimeStamp: 40, Payload: video})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var client RtmpConn
+	client.Init(RTMP_DEFAULT_CHUNK_SIZE, conn, nil)
+	client.SetRtmpe(rtmpe)
+	defer client.Close()
+
+	if err := client.SendHandshakeC0C1(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if client.IsEncrypted() != rtmpe {
+		t.Fatalf("client encrypted = %v, want %v", client.IsEncrypted(), rtmpe)
+	}
+
+	var amf Amf0
+	amf.WriteString("connect")
+	amf.WriteNumber(1)
+	amf.WriteObjectBegin()
+	amf.WritePropertyString("app", "live")
+	amf.WriteObjectEnd()
+	if err := client.WriteMessage(&RtmpMessage{MessageType: AMF_TYPE_INVOKE, Payload: amf.GetData()}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MessageType != AMF_TYPE_VIDEO || m.StreamId != 1 || m.TimeStamp != 40 || !bytes.Equal(m.Payload, video) {
+		t.Fatalf("client read type %d stream %d time %d with %d bytes", m.MessageType, m.StreamId, m.TimeStamp, len(m.Payload))
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
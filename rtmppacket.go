@@ -3,7 +3,6 @@ package rtmp
 import (
 	"bytes"
 	"fmt"
-	"io"
 )
 
 import "encoding/binary"
@@ -15,163 +14,295 @@ const (
 	PACKET_FMT_1  = 3
 )
 
+const (
+	RTMP_DEFAULT_CHUNK_SIZE   = 128
+	RTMP_MAX_CHUNK_SIZE       = 0x7FFFFFFF
+	RTMP_CONTROL_CHUNK_STREAM = 2
+)
+
+// The chunk stream IDs a basic header can carry. 0 and 1 announce the 2 and
+// 3 byte forms rather than naming a chunk stream.
+const (
+	RTMP_MIN_CHUNK_STREAM_ID = 2
+	RTMP_MAX_CHUNK_STREAM_ID = 65599
+)
+
+const (
+	RTMP_DEFAULT_MAX_MESSAGE_SIZE = 8 * 1024 * 1024
+	RTMP_DEFAULT_MAX_PENDING_SIZE = 32 * 1024 * 1024
+)
+
+// RTMP_MAX_MESSAGE_LENGTH is the largest message the 3 byte length field of
+// a chunk header can describe.
+const RTMP_MAX_MESSAGE_LENGTH = 0xFFFFFF
+
+const (
+	RTMP_LIMIT_HARD    = 0
+	RTMP_LIMIT_SOFT    = 1
+	RTMP_LIMIT_DYNAMIC = 2
+)
+
 const (
 	AMF_SET_CHUNKSIZE = 0x01
-	AMF_STREAM_BEGIN  = 0x04
+	AMF_ABORT         = 0x02
+	AMF_ACK           = 0x03
+	AMF_USER_CONTROL  = 0x04
 	AMF_ACK_SIZE      = 0x05
 	AMF_BAND_WIDTH    = 0x06
 	AMF_TYPE_AUDIO    = 0x08
 	AMF_TYPE_VIDEO    = 0x09
 	AMF_TYPE_NOTIFY   = 0x12
 	AMF_TYPE_INVOKE   = 0x14
+
+	// The same for peers that set objectEncoding 3. The payload starts with
+	// a format byte of 0 and goes on as AMF0, with AMF3 values behind
+	// AMF0_AVMPLUS_OBJECT.
+	AMF_TYPE_NOTIFY_AMF3 = 0x0F
+	AMF_TYPE_INVOKE_AMF3 = 0x11
 )
 
 type RtmpPacket struct {
-	timeStamp     int
+	timeStamp     uint32
 	bodySize      int
 	headerLen     int
 	hasExtendedTs bool
 	packetType    int
 	bodyData      []byte
 	packetLen     int
-	extTimestamp  int
-	chunkStreamId byte
+	chunkStreamId int
+	streamId      uint32
+	complete      bool
+	chunkEnds     []int
 }
 
-func (r *RtmpPacket) Decode(b []byte, dataLen int, chunkSize int, preBodySize int, preTimeStamp int, prePacketType int) bool {
-	if dataLen < 1 {
-		return false
+// Decode reads a single chunk from b and appends its payload to the partial
+// message of its chunk stream. It returns ErrShortBuffer, leaving cs as it
+// was, when b does not yet hold the whole chunk, and ErrMalformedChunk if the
+// chunk breaks the protocol. On success GetPacketLen reports how many bytes
+// the chunk used and IsComplete whether it finished a message. When only the
+// payload is short, GetPacketLen and GetBodySize already report the chunk and
+// message lengths.
+func (r *RtmpPacket) Decode(b []byte, dataLen int, chunkSize int, cs *RtmpChunkStream) error {
+	headerType, chunkStreamId, basicLen, err := r.DecodeBasicHeader(b, dataLen)
+	if err != nil {
+		return err
 	}
 
-	headerType := (b[0] & 0xC0) >> 6
-
-	headerLen, ret := r.checkEnoughHeader(int(headerType), dataLen)
+	headerLen, ret := r.checkEnoughHeader(int(headerType), basicLen, dataLen)
 	if !ret {
-		return false
+		return ErrShortBuffer
+	}
+
+	// fmt 2 and 3 leave out the message length and type, so they can not
+	// start a chunk stream. Some encoders do start with fmt 1, which is
+	// let through with its delta taken from zero.
+	if (headerType == PACKET_FMT_4 || headerType == PACKET_FMT_1) && !cs.hasHeader {
+		return fmt.Errorf("%w: fmt %d chunk on new chunk stream %d", ErrMalformedChunk, headerType, chunkStreamId)
 	}
 
 	//fmt.Println("headertype=", headerType)
 
-	r.chunkStreamId = byte(b[0] & 0x3F)
+	// Message header fields start right after the basic header.
+	h := b[basicLen:]
+
+	r.chunkStreamId = chunkStreamId
+	r.streamId = 0
 	r.timeStamp = 0
 	r.bodySize = 0
 	r.headerLen = headerLen
+	r.packetLen = 0
 	r.hasExtendedTs = false
 	r.packetType = 0
+	r.bodyData = nil
+	r.complete = false
 
-	if headerType == PACKET_FMT_12 || headerType == PACKET_FMT_8 || headerType == PACKET_FMT_4 {
+	var timeTs uint32
 
-		timeValueAry := []byte{0, b[1], b[2], b[3]}
-		//fmt.Printf("bodysizeary=%v", timeValueAry)
-		timeTs := r.bytes2Int(timeValueAry)
+	if headerType == PACKET_FMT_12 || headerType == PACKET_FMT_8 || headerType == PACKET_FMT_4 {
 
-		if timeTs == 0xFFFFFF {
-			r.hasExtendedTs = true
-			if headerLen+4 > dataLen {
-				fmt.Println("find extended timestamp, but data leng not enough")
-				return false
-			}
+		timeTs = uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+		r.hasExtendedTs = timeTs == 0xFFFFFF
 
-			headerLen += 4
+	} else {
 
-			timeExtValueAry := []byte{b[headerLen-4], b[headerLen-3], b[headerLen-2], b[headerLen-1]}
-			extendedTimeStamp := r.bytes2Int(timeExtValueAry)
+		// fmt 3 chunks repeat the extended timestamp field whenever the
+		// header they inherit from used one.
+		r.hasExtendedTs = cs.hasExtendedTs
+	}
 
-			r.extTimestamp = extendedTimeStamp
+	if r.hasExtendedTs {
+		if headerLen+4 > dataLen {
+			return ErrShortBuffer
 		}
+
+		timeTs = binary.BigEndian.Uint32(b[headerLen : headerLen+4])
+		headerLen += 4
 	}
 
+	// A fmt 3 chunk on a stream with a partial message is a continuation and
+	// carries no header fields of its own. Any other chunk starts a message.
+	continuation := headerType == PACKET_FMT_1 && cs.started
+
+	// fmt 0 carries an absolute timestamp, fmt 1 and 2 a delta against the
+	// previous message on this chunk stream, fmt 3 repeats the last delta.
+	// Timestamps are 32 bits and wrap around, so the sums are left to
+	// overflow.
+	timeDelta := cs.timeDelta
+
 	if headerType == PACKET_FMT_12 || headerType == PACKET_FMT_8 {
 
-		bodySizeAry := []byte{0, b[4], b[5], b[6]}
+		bodySizeAry := []byte{0, h[3], h[4], h[5]}
 		//fmt.Printf("bodysizeary=%v", bodySizeAry)
 		r.bodySize = r.bytes2Int(bodySizeAry)
-		r.packetType = int(b[7])
+		r.packetType = int(h[6])
 
-	} else if headerType == PACKET_FMT_4 {
+	} else {
 
-		r.bodySize = preBodySize
-		r.packetType = prePacketType
+		r.bodySize = cs.bodySize
+		r.packetType = cs.packetType
+	}
 
-	} else if headerType == PACKET_FMT_1 {
+	// Only fmt 0 carries the message stream ID, stored little-endian.
+	if headerType == PACKET_FMT_12 {
+		r.streamId = binary.LittleEndian.Uint32(h[7:11])
+	} else {
+		r.streamId = cs.streamId
+	}
 
-		r.bodySize = preBodySize
-		r.packetType = prePacketType
-		r.timeStamp = preTimeStamp
+	if continuation {
+		r.timeStamp = cs.timeStamp
+	} else if headerType == PACKET_FMT_12 {
+		r.timeStamp = timeTs
+		timeDelta = timeTs
+	} else if headerType == PACKET_FMT_8 || headerType == PACKET_FMT_4 {
+		r.timeStamp = cs.timeStamp + timeTs
+		timeDelta = timeTs
+	} else {
+		r.timeStamp = cs.timeStamp + timeDelta
 	}
 
 	//fmt.Printf("bodysize=%d packetType=%d timestamp=%d\n", r.bodySize, r.packetType, r.timeStamp)
 
-	modChunkCount := r.bodySize % chunkSize
-	chunkCount := 0
-
-	if modChunkCount == 0 {
-		chunkCount = r.bodySize/chunkSize - 1
-		modChunkCount = chunkSize
-	} else {
+	received := 0
+	if continuation {
+		received = len(cs.bodyData)
+	}
 
-		chunkCount = (r.bodySize - modChunkCount) / chunkSize
+	payloadLen := r.bodySize - received
+	if payloadLen > chunkSize {
+		payloadLen = chunkSize
 	}
 
-	r.packetLen = headerLen + r.bodySize + chunkCount
+	r.packetLen = headerLen + payloadLen
 
-	//fmt.Println("packetlen=", r.packetLen, "mod count=", modChunkCount)
+	//fmt.Println("packetlen=", r.packetLen)
 
 	if r.packetLen > dataLen {
-		fmt.Println("packet len > dataLen error")
-		return false
+		return ErrShortBuffer
 	}
 
-	var bufferData bytes.Buffer
+	if !continuation {
+		cs.bodyData = getBody(r.bodySize)
+	}
 
-	if chunkCount > 0 {
-		//r.bodyData = b[headerLen : headerLen+chunkSize]
-		bufferData.Write(b[headerLen : headerLen+chunkSize])
+	cs.bodyData = append(cs.bodyData, b[headerLen:r.packetLen]...)
+	cs.bodySize = r.bodySize
+	cs.packetType = r.packetType
+	cs.streamId = r.streamId
+	cs.timeStamp = r.timeStamp
+	cs.timeDelta = timeDelta
+	cs.hasExtendedTs = r.hasExtendedTs
+	cs.hasHeader = true
+	cs.started = true
+
+	if len(cs.bodyData) == r.bodySize {
+		r.bodyData = cs.bodyData
+		r.complete = true
+		cs.bodyData = nil
+		cs.started = false
+	}
 
-		var i int
-		var offset int
-		for i = 1; i < chunkCount; i++ {
+	//fmt.Println("body len=", len(r.bodyData), "body=", r.bodyData)
 
-			offset = (headerLen + chunkSize*i) + i
-			bufferData.Write(b[offset : offset+chunkSize])
-			//r.bodyData = append(r.bodyData, b[offset:offset+chunkSize])
-			//fmt.Printf("offset=%d i=%d headlen=%d\n", offset, i, headerLen)
-		}
+	return nil
+}
 
-		if modChunkCount > 0 {
-			//fmt.Printf("offset=%d i=%d headlen=%d\n", offset, i, headerLen)
-			offset := (headerLen + chunkSize*i) + i
-			bufferData.Write(b[offset : offset+modChunkCount])
-			//r.bodyData = append(r.bodyData, b[offset:offset+chunkSize])
-		}
+func (r *RtmpPacket) HasExtendedTimeStamp() bool {
+	return r.hasExtendedTs
+}
 
-	} else {
-		bufferData.Write(b[headerLen:r.packetLen])
+func (r *RtmpPacket) GetPacketLen() int {
+	return r.packetLen
+}
+
+func (r *RtmpPacket) IsComplete() bool {
+	return r.complete
+}
+
+// DecodeBasicHeader reads the 1, 2 or 3 byte basic header at the start of b
+// and returns the header fmt, the chunk stream ID and the basic header length.
+func (r *RtmpPacket) DecodeBasicHeader(b []byte, dataLen int) (byte, int, int, error) {
+	if dataLen < 1 {
+		return 0, 0, 0, ErrShortBuffer
 	}
 
-	r.bodyData = bufferData.Bytes()
+	headerType := (b[0] & 0xC0) >> 6
 
-	//fmt.Println("body len=", len(r.bodyData), "body=", r.bodyData)
+	switch b[0] & 0x3F {
+	case 0:
+		if dataLen < 2 {
+			return headerType, 0, 2, ErrShortBuffer
+		}
+		return headerType, int(b[1]) + 64, 2, nil
+	case 1:
+		if dataLen < 3 {
+			return headerType, 0, 3, ErrShortBuffer
+		}
+		return headerType, int(b[2])*256 + int(b[1]) + 64, 3, nil
+	}
 
-	return true
+	return headerType, int(b[0] & 0x3F), 1, nil
 }
 
-func (r *RtmpPacket) GetPacketLen() int {
-	return r.packetLen
+// isValidChunkStreamId reports whether chunkStreamId can be sent in a basic
+// header.
+func isValidChunkStreamId(chunkStreamId int) bool {
+	return chunkStreamId >= RTMP_MIN_CHUNK_STREAM_ID && chunkStreamId <= RTMP_MAX_CHUNK_STREAM_ID
+}
+
+// writeBasicHeader writes the shortest basic header able to carry
+// chunkStreamId, which must pass isValidChunkStreamId.
+func (r *RtmpPacket) writeBasicHeader(bufData *bytes.Buffer, headerType byte, chunkStreamId int) {
+	switch {
+	case chunkStreamId < 64:
+		bufData.WriteByte(headerType<<6 | byte(chunkStreamId))
+	case chunkStreamId < 320:
+		bufData.WriteByte(headerType << 6)
+		bufData.WriteByte(byte(chunkStreamId - 64))
+	default:
+		bufData.WriteByte(headerType<<6 | 0x01)
+		bufData.WriteByte(byte((chunkStreamId - 64) & 0xFF))
+		bufData.WriteByte(byte((chunkStreamId - 64) >> 8))
+	}
+}
+
+func (r *RtmpPacket) writeStreamId(bufData *bytes.Buffer, streamId uint32) {
+	streamIdAry := make([]byte, 4)
+	binary.LittleEndian.PutUint32(streamIdAry, streamId)
+	bufData.Write(streamIdAry)
 }
 
-func (r *RtmpPacket) checkEnoughHeader(headerType int, dataLen int) (int, bool) {
-	headerLen := 0
+func (r *RtmpPacket) checkEnoughHeader(headerType int, basicLen int, dataLen int) (int, bool) {
+	headerLen := basicLen
 
 	switch {
 	case headerType == PACKET_FMT_12:
-		headerLen = 12
+		headerLen += 11
 	case headerType == PACKET_FMT_8:
-		headerLen = 8
+		headerLen += 7
 	case headerType == PACKET_FMT_4:
-		headerLen = 4
+		headerLen += 3
 	case headerType == PACKET_FMT_1:
-		headerLen = 1
 	}
 
 	if dataLen >= headerLen {
@@ -190,6 +321,10 @@ func (r *RtmpPacket) bytes2Int(b []byte) int {
 
 }
 
+func (r *RtmpPacket) GetStreamId() uint32 {
+	return r.streamId
+}
+
 func (r *RtmpPacket) GetPacketType() int {
 	return r.packetType
 }
@@ -198,135 +333,123 @@ func (r *RtmpPacket) GetBodyData() []byte {
 	return r.bodyData
 }
 
-func (r *RtmpPacket) AckPacket(chunkStreamId byte, ackSize uint32) []byte {
-	var bufData bytes.Buffer
-	ackByteAry := make([]byte, 4)
-
-	bufData.WriteByte(chunkStreamId)
-	bufData.Write([]byte{0x00, 0x00, 0x00})
-	bufData.Write([]byte{0x00, 0x00, 0x04})
-	bufData.WriteByte(0x05)
-	bufData.Write([]byte{0x00, 0x00, 0x00, 0x00})
-
-	binary.BigEndian.PutUint32(ackByteAry, ackSize)
-
-	bufData.Write(ackByteAry)
-
-	return bufData.Bytes()
+func (r *RtmpPacket) GetChunkStreamId() int {
+	return r.chunkStreamId
 }
 
-func (r *RtmpPacket) GetChunkStreamId() byte {
-	return r.chunkStreamId
+// Init sets r up as an outbound message to be passed to Encode.
+func (r *RtmpPacket) Init(chunkStreamId int, streamId uint32, packetType int, timeStamp uint32, bodyData []byte) {
+	r.chunkStreamId = chunkStreamId
+	r.streamId = streamId
+	r.packetType = packetType
+	r.timeStamp = timeStamp
+	r.bodyData = bodyData
+	r.bodySize = len(bodyData)
+	r.hasExtendedTs = false
+	r.complete = true
 }
 
-func (r *RtmpPacket) SetPeerBandwidthPacket(chunkStreamId byte, bandwidthSize uint32) []byte {
+// Encode splits the message into chunks of at most chunkSize bytes. The
+// first chunk gets the smallest header that lets the peer rebuild the
+// message from the last one sent on cs, and cs is updated to this message.
+func (r *RtmpPacket) Encode(chunkSize int, cs *RtmpChunkStream) []byte {
 	var bufData bytes.Buffer
-	bandwidthAry := make([]byte, 4)
 
-	bufData.WriteByte(chunkStreamId)
-	bufData.Write([]byte{0x00, 0x00, 0x00})
-	bufData.Write([]byte{0x00, 0x00, 0x05})
-	bufData.WriteByte(0x06)
-	bufData.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	// A delta with the top bit set means the timestamp went backwards,
+	// which only a fmt 0 header can express.
+	timeDelta := r.timeStamp - cs.timeStamp
 
-	binary.BigEndian.PutUint32(bandwidthAry, bandwidthSize)
-
-	bufData.Write(bandwidthAry)
-	bufData.WriteByte(0x02)
-
-	return bufData.Bytes()
-}
+	var headerType byte = PACKET_FMT_12
+	if cs.hasHeader && r.streamId == cs.streamId && timeDelta < 0x80000000 {
+		if r.bodySize != cs.bodySize || r.packetType != cs.packetType {
+			headerType = PACKET_FMT_8
+		} else if !cs.hasTimeDelta || timeDelta != cs.timeDelta {
+			headerType = PACKET_FMT_4
+		} else {
+			headerType = PACKET_FMT_1
+		}
+	}
 
-func (r *RtmpPacket) ControlMessagePacket(chunkStreamId byte, eventType uint16) []byte {
-	var bufData bytes.Buffer
-	eventTypeAry := make([]byte, 2)
+	timeField := timeDelta
+	if headerType == PACKET_FMT_12 {
+		timeField = r.timeStamp
+	}
 
-	bufData.WriteByte(chunkStreamId)
-	bufData.Write([]byte{0x00, 0x00, 0x00})
-	bufData.Write([]byte{0x00, 0x00, 0x06})
-	bufData.WriteByte(0x04)
-	bufData.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	r.hasExtendedTs = timeField >= 0xFFFFFF
 
-	binary.BigEndian.PutUint16(eventTypeAry, eventType)
+	r.writeBasicHeader(&bufData, headerType, r.chunkStreamId)
 
-	bufData.Write(eventTypeAry)
-	bufData.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	if headerType != PACKET_FMT_1 {
+		timeValue := timeField
+		if r.hasExtendedTs {
+			timeValue = 0xFFFFFF
+		}
+		bufData.Write([]byte{byte(timeValue >> 16), byte(timeValue >> 8), byte(timeValue)})
+	}
 
-	return bufData.Bytes()
-}
+	if headerType == PACKET_FMT_12 || headerType == PACKET_FMT_8 {
+		bufData.Write([]byte{byte(r.bodySize >> 16), byte(r.bodySize >> 8), byte(r.bodySize)})
+		bufData.WriteByte(byte(r.packetType))
+	}
 
-func (r *RtmpPacket) InvokeMessage(headerType byte, chunkStreamId byte, timeStamp int, bodyData []byte, chunkSize int) []byte {
-	var bufData bytes.Buffer
-	var tempBodySizeBuf = make([]byte, 4)
+	if headerType == PACKET_FMT_12 {
+		r.writeStreamId(&bufData, r.streamId)
+	}
 
-	var headerFormat byte
-	headerFormat = headerType<<6 | chunkStreamId
+	extTimeAry := make([]byte, 4)
+	binary.BigEndian.PutUint32(extTimeAry, timeField)
 
-	//fmt.Printf("header format=%d\n", headerFormat)
+	if r.hasExtendedTs {
+		bufData.Write(extTimeAry)
+	}
 
-	binary.BigEndian.PutUint32(tempBodySizeBuf, uint32(len(bodyData)))
+	r.chunkEnds = r.chunkEnds[:0]
 
-	bufData.WriteByte(headerFormat)
+	offset := 0
+	for {
+		payloadLen := r.bodySize - offset
+		if payloadLen > chunkSize {
+			payloadLen = chunkSize
+		}
 
-	switch headerType {
-	case PACKET_FMT_12:
-		bufData.Write([]byte{0x00, 0x00, 0x00})
-		bufData.Write(tempBodySizeBuf[1:])
-		bufData.WriteByte(0x14)
-		bufData.Write([]byte{0x00, 0x00, 0x00, 0x00})
-	case PACKET_FMT_8:
-		bufData.Write([]byte{0x00, 0x00, 0x00})
-		bufData.Write(tempBodySizeBuf[1:])
-		bufData.WriteByte(0x14)
-	case PACKET_FMT_4:
-		bufData.Write([]byte{0x00, 0x00, 0x00})
-	case PACKET_FMT_1:
+		bufData.Write(r.bodyData[offset : offset+payloadLen])
+		offset += payloadLen
+		r.chunkEnds = append(r.chunkEnds, bufData.Len())
 
-	}
+		if offset >= r.bodySize {
+			break
+		}
 
-	if len(bodyData) <= chunkSize {
-		bufData.Write(bodyData)
-	} else {
-		chunkData := r.PackBodyChunk(chunkStreamId, chunkSize, bodyData)
-		bufData.Write(chunkData)
+		r.writeBasicHeader(&bufData, PACKET_FMT_1, r.chunkStreamId)
+		if r.hasExtendedTs {
+			bufData.Write(extTimeAry)
+		}
 	}
 
-	/*
-		for i := 12; i < len(bufData.Bytes()); i++ {
-			if (i-12)%16 == 0 {
-				fmt.Printf("\n")
-			}
-
-			fmt.Printf("%02X ", bufData.Bytes()[i])
-		}
-	*/
+	cs.hasHeader = true
+	cs.streamId = r.streamId
+	cs.bodySize = r.bodySize
+	cs.packetType = r.packetType
+	cs.timeStamp = r.timeStamp
+	cs.timeDelta = timeField
+	cs.hasTimeDelta = headerType != PACKET_FMT_12
+	cs.hasExtendedTs = r.hasExtendedTs
 
 	return bufData.Bytes()
 }
 
-func (r *RtmpPacket) PackBodyChunk(chunkStreamId byte, chunkSize int, bodyData []byte) []byte {
-	dataLen := len(bodyData)
-	input := bytes.NewBuffer(bodyData)
-	output := new(bytes.Buffer)
-	io.CopyN(output, input, int64(chunkSize))
-	remain := dataLen - chunkSize
-	for {
-		output.WriteByte(0xC0 | chunkStreamId)
-		if remain > chunkSize {
-			io.CopyN(output, input, int64(chunkSize))
-			remain -= chunkSize
-		} else {
-			io.CopyN(output, input, int64(remain))
-			break
-		}
-	}
-	return output.Bytes()
+// GetChunkEnds returns the offset just past each chunk in the last output of
+// Encode, the points at which writing the message can be stopped.
+func (r *RtmpPacket) GetChunkEnds() []int {
+	return r.chunkEnds
 }
 
 func (r *RtmpPacket) GetBodySize() int {
 	return r.bodySize
 }
 
-func (r *RtmpPacket) GetTimeStamp() int {
+// GetTimeStamp returns the absolute message timestamp in milliseconds. It is
+// 32 bits wide and wraps around after roughly 49.7 days.
+func (r *RtmpPacket) GetTimeStamp() uint32 {
 	return r.timeStamp
 }
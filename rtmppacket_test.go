@@ -0,0 +1,255 @@
+package rtmp
+
+import "bytes"
+import "errors"
+import "net"
+import "testing"
+
+type testMessage struct {
+	chunkStreamId int
+	streamId      uint32
+	packetType    int
+	timeStamp     uint32
+	bodySize      int
+
+	// The header fmt the first chunk is expected to get.
+	headerType byte
+}
+
+// testBody returns a body whose bytes depend on the message, so that chunks
+// put into the wrong message show up.
+func testBody(m testMessage) []byte {
+	body := make([]byte, m.bodySize)
+	for i := range body {
+		body[i] = byte(i + m.chunkStreamId*7 + int(m.timeStamp))
+	}
+
+	return body
+}
+
+// testChunks encodes messages in order with one send table and returns the
+// chunks of each.
+func testChunks(t *testing.T, chunkSize int, messages []testMessage) [][][]byte {
+	t.Helper()
+
+	send := make(map[int]*RtmpChunkStream)
+	chunks := make([][][]byte, len(messages))
+
+	for i, m := range messages {
+		cs, ok := send[m.chunkStreamId]
+		if !ok {
+			cs = new(RtmpChunkStream)
+			cs.Init(m.chunkStreamId)
+			send[m.chunkStreamId] = cs
+		}
+
+		var packet RtmpPacket
+		packet.Init(m.chunkStreamId, m.streamId, m.packetType, m.timeStamp, testBody(m))
+		data := append([]byte(nil), packet.Encode(chunkSize, cs)...)
+
+		if headerType := data[0] >> 6; headerType != m.headerType {
+			t.Errorf("message %d: fmt %d, want %d", i, headerType, m.headerType)
+		}
+
+		start := 0
+		for _, end := range packet.GetChunkEnds() {
+			chunks[i] = append(chunks[i], data[start:end])
+			start = end
+		}
+	}
+
+	return chunks
+}
+
+// testDecode decodes the chunks in order with one receive table and checks
+// that the messages they finish are the ones wanted, in order.
+func testDecode(t *testing.T, chunkSize int, chunks [][]byte, want []testMessage) {
+	t.Helper()
+
+	recv := make(map[int]*RtmpChunkStream)
+	var got []RtmpPacket
+
+	for i, chunk := range chunks {
+		var packet RtmpPacket
+		_, chunkStreamId, _, err := packet.DecodeBasicHeader(chunk, len(chunk))
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+
+		cs, ok := recv[chunkStreamId]
+		if !ok {
+			cs = new(RtmpChunkStream)
+			cs.Init(chunkStreamId)
+			recv[chunkStreamId] = cs
+		}
+
+		if err := packet.Decode(chunk, len(chunk), chunkSize, cs); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if packet.GetPacketLen() != len(chunk) {
+			t.Fatalf("chunk %d: used %d of %d bytes", i, packet.GetPacketLen(), len(chunk))
+		}
+		if packet.IsComplete() {
+			got = append(got, packet)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("%d messages decoded, want %d", len(got), len(want))
+	}
+
+	for i, m := range want {
+		p := got[i]
+		if p.GetChunkStreamId() != m.chunkStreamId || p.GetStreamId() != m.streamId ||
+			p.GetPacketType() != m.packetType || p.GetTimeStamp() != m.timeStamp {
+			t.Errorf("message %d: got csid %d stream %d type %d time %d, want %+v", i,
+				p.GetChunkStreamId(), p.GetStreamId(), p.GetPacketType(), p.GetTimeStamp(), m)
+		}
+		if !bytes.Equal(p.GetBodyData(), testBody(m)) {
+			t.Errorf("message %d: body differs", i)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		messages  []testMessage
+	}{
+		{
+			name:      "header compression",
+			chunkSize: 128,
+			messages: []testMessage{
+				{6, 1, AMF_TYPE_VIDEO, 0, 300, PACKET_FMT_12},
+				// Same stream, new length: fmt 1.
+				{6, 1, AMF_TYPE_VIDEO, 40, 200, PACKET_FMT_8},
+				// Same length and type, new delta: fmt 2.
+				{6, 1, AMF_TYPE_VIDEO, 73, 200, PACKET_FMT_4},
+				// Same delta: fmt 3.
+				{6, 1, AMF_TYPE_VIDEO, 106, 200, PACKET_FMT_1},
+				// New message stream: fmt 0.
+				{6, 2, AMF_TYPE_VIDEO, 139, 200, PACKET_FMT_12},
+				// Timestamp going back: fmt 0.
+				{6, 2, AMF_TYPE_VIDEO, 100, 200, PACKET_FMT_12},
+			},
+		},
+		{
+			name:      "basic header forms",
+			chunkSize: 64,
+			messages: []testMessage{
+				{2, 0, AMF_ACK, 0, 4, PACKET_FMT_12},
+				{63, 1, AMF_TYPE_AUDIO, 0, 100, PACKET_FMT_12},
+				{64, 1, AMF_TYPE_AUDIO, 0, 100, PACKET_FMT_12},
+				{319, 1, AMF_TYPE_AUDIO, 0, 100, PACKET_FMT_12},
+				{320, 1, AMF_TYPE_AUDIO, 0, 100, PACKET_FMT_12},
+				{65599, 1, AMF_TYPE_AUDIO, 0, 100, PACKET_FMT_12},
+				{65599, 1, AMF_TYPE_AUDIO, 20, 100, PACKET_FMT_4},
+			},
+		},
+		{
+			name:      "extended timestamps",
+			chunkSize: 128,
+			messages: []testMessage{
+				// Extended in the fmt 0 header and every continuation.
+				{4, 1, AMF_TYPE_VIDEO, 0x1000000, 500, PACKET_FMT_12},
+				// Extended delta in a fmt 1 header.
+				{4, 1, AMF_TYPE_VIDEO, 0x2000000, 300, PACKET_FMT_8},
+				// The same extended delta again, in fmt 3 only.
+				{4, 1, AMF_TYPE_VIDEO, 0x3000000, 300, PACKET_FMT_1},
+				// Back to a small delta.
+				{4, 1, AMF_TYPE_VIDEO, 0x3000010, 300, PACKET_FMT_4},
+			},
+		},
+		{
+			name:      "timestamp wraparound",
+			chunkSize: 128,
+			messages: []testMessage{
+				{4, 1, AMF_TYPE_AUDIO, 0xFFFFFFF0, 200, PACKET_FMT_12},
+				// The delta of 0x20 wraps the 32 bit timestamp.
+				{4, 1, AMF_TYPE_AUDIO, 0x10, 200, PACKET_FMT_4},
+				{4, 1, AMF_TYPE_AUDIO, 0x30, 200, PACKET_FMT_1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunks [][]byte
+			for _, messageChunks := range testChunks(t, tt.chunkSize, tt.messages) {
+				chunks = append(chunks, messageChunks...)
+			}
+			testDecode(t, tt.chunkSize, chunks, tt.messages)
+		})
+	}
+}
+
+func TestPacketInterleaved(t *testing.T) {
+	const chunkSize = 100
+
+	audio := []testMessage{
+		{4, 1, AMF_TYPE_AUDIO, 0x1000000, 250, PACKET_FMT_12},
+		{4, 1, AMF_TYPE_AUDIO, 0x1000020, 250, PACKET_FMT_4},
+	}
+	video := []testMessage{
+		{320, 1, AMF_TYPE_VIDEO, 0x1000000, 1000, PACKET_FMT_12},
+	}
+
+	audioChunks := testChunks(t, chunkSize, audio)
+	videoChunks := testChunks(t, chunkSize, video)[0]
+
+	// Alternate one video chunk with one audio chunk until both run out.
+	var pending [][]byte
+	for _, messageChunks := range audioChunks {
+		pending = append(pending, messageChunks...)
+	}
+
+	var chunks [][]byte
+	var want []testMessage
+	audioDone := 0
+	audioLeft := len(audioChunks[0])
+
+	for len(videoChunks) > 0 || len(pending) > 0 {
+		if len(videoChunks) > 0 {
+			chunks = append(chunks, videoChunks[0])
+			videoChunks = videoChunks[1:]
+			if len(videoChunks) == 0 {
+				want = append(want, video[0])
+			}
+		}
+		if len(pending) > 0 {
+			chunks = append(chunks, pending[0])
+			pending = pending[1:]
+			audioLeft--
+			if audioLeft == 0 {
+				want = append(want, audio[audioDone])
+				audioDone++
+				if audioDone < len(audioChunks) {
+					audioLeft = len(audioChunks[audioDone])
+				}
+			}
+		}
+	}
+
+	testDecode(t, chunkSize, chunks, want)
+}
+
+func TestSendPacketTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var c RtmpConn
+	c.Init(RTMP_DEFAULT_CHUNK_SIZE, client, nil)
+
+	body := make([]byte, RTMP_MAX_MESSAGE_LENGTH+1)
+	err := c.SendPacket(6, 1, AMF_TYPE_VIDEO, 0, body)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("SendPacket returned %v, want ErrMessageTooLarge", err)
+	}
+
+	err = c.SendPacket(RTMP_MAX_CHUNK_STREAM_ID+1, 1, AMF_TYPE_VIDEO, 0, nil)
+	if !errors.Is(err, ErrInvalidChunkStream) {
+		t.Fatalf("SendPacket returned %v, want ErrInvalidChunkStream", err)
+	}
+}
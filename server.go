@@ -0,0 +1,273 @@
+package rtmp
+
+import "context"
+import "errors"
+import "log/slog"
+import "net"
+import "runtime/debug"
+import "sync"
+import "time"
+
+var ErrServerClosed = errors.New("rtmp: server closed")
+
+// Server accepts RTMP connections and runs a read loop for each of them,
+// feeding an RtmpConn whose commands go to Handler. If Handler also
+// implements ConnStateProc it is told when connections open and close.
+// A nil Handler answers connect and ignores every other command. A panic in
+// Handler closes the connection it happened on and is logged.
+// Logger, if set, is used for the server and each of its connections.
+// MaxMessageSize, if set, replaces RTMP_DEFAULT_MAX_MESSAGE_SIZE.
+type Server struct {
+	Handler          InvokeProc
+	Logger           *slog.Logger
+	ChunkSize        int
+	MaxMessageSize   int
+	HandshakeTimeout time.Duration
+	ConnectTimeout   time.Duration
+	IdleTimeout      time.Duration
+	WriteTimeout     time.Duration
+
+	lock         sync.Mutex
+	listeners    map[net.Listener]bool
+	conns        map[*RtmpConn]net.Conn
+	shuttingDown bool
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	if s.isShuttingDown() {
+		return ErrServerClosed
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server is shut
+// down, in which case ErrServerClosed is returned. l is closed on return.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	var retryDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+
+			// Back off on errors such as running out of file descriptors.
+			var tempErr interface{ Temporary() bool }
+			if errors.As(err, &tempErr) && tempErr.Temporary() {
+				if retryDelay == 0 {
+					retryDelay = 5 * time.Millisecond
+				} else if retryDelay < time.Second {
+					retryDelay *= 2
+				}
+				s.logger().Warn("accept failed", "err", err, "retry_in", retryDelay)
+				time.Sleep(retryDelay)
+				continue
+			}
+
+			return err
+		}
+
+		retryDelay = 0
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = RTMP_DEFAULT_CHUNK_SIZE
+	}
+
+	c := new(RtmpConn)
+	c.Init(chunkSize, conn, s.Handler)
+	c.SetLogger(s.Logger)
+	if s.MaxMessageSize > 0 {
+		c.SetMaxMessageSize(s.MaxMessageSize)
+	}
+	c.SetHandshakeTimeout(s.HandshakeTimeout)
+	c.SetConnectTimeout(s.ConnectTimeout)
+	c.SetIdleTimeout(s.IdleTimeout)
+	c.SetWriteTimeout(s.WriteTimeout)
+
+	if !s.trackConn(c, conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackConn(c, conn, false)
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.GetLogger().Error("panic serving connection", "panic", r, "stack", string(debug.Stack()))
+			c.Close()
+		}
+	}()
+
+	c.GetLogger().Debug("accepted connection")
+
+	stateHandler, hasState := s.Handler.(ConnStateProc)
+	if hasState {
+		stateHandler.OnConnOpen(c)
+		defer stateHandler.OnConnClose(c)
+	}
+
+	buf := make([]byte, 4096)
+	for !c.IsClosed() {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			c.OnRecv(buf, n)
+		}
+
+		if err != nil {
+			c.OnReadError(err)
+			break
+		}
+	}
+}
+
+// Shutdown stops accepting connections, closes those that have not sent
+// connect yet and waits for the others to end. If ctx expires first the
+// remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.shuttingDown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// Checked on every round, as a connection may be in the middle
+		// of its handshake when Shutdown starts.
+		s.closeUnconnected()
+
+		if s.connCount() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting connections and closes the open ones right away.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.shuttingDown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
+
+	s.closeConns()
+
+	return nil
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return discardLogger
+	}
+
+	return s.Logger
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.shuttingDown
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+
+	if s.shuttingDown {
+		return false
+	}
+
+	s.listeners[l] = true
+
+	return true
+}
+
+func (s *Server) trackConn(c *RtmpConn, conn net.Conn, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*RtmpConn]net.Conn)
+	}
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+
+	if s.shuttingDown {
+		return false
+	}
+
+	s.conns[c] = conn
+
+	return true
+}
+
+func (s *Server) connCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.conns)
+}
+
+// closeUnconnected closes the connections still in the handshake or waiting
+// for connect.
+func (s *Server) closeUnconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c, conn := range s.conns {
+		if !c.IsConnected() {
+			conn.Close()
+		}
+	}
+}
+
+// closeConns closes the network connections underneath, which makes each
+// read loop fail and clean up after itself.
+func (s *Server) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
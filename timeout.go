@@ -0,0 +1,45 @@
+package rtmp
+
+import "errors"
+import "net"
+import "os"
+
+const (
+	TIMEOUT_HANDSHAKE = "handshake"
+	TIMEOUT_CONNECT   = "connect"
+	TIMEOUT_IDLE      = "idle"
+	TIMEOUT_WRITE     = "write"
+)
+
+// TimeoutError is reported through OnError when one of the RtmpConn
+// deadlines expires. Phase is one of the TIMEOUT_* constants.
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return "rtmp: " + e.Phase + " timeout: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return false
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,75 @@
+package rtmp
+
+import "encoding/binary"
+import "fmt"
+
+const (
+	USER_CONTROL_STREAM_BEGIN       = 0
+	USER_CONTROL_STREAM_EOF         = 1
+	USER_CONTROL_STREAM_DRY         = 2
+	USER_CONTROL_SET_BUFFER_LENGTH  = 3
+	USER_CONTROL_STREAM_IS_RECORDED = 4
+	USER_CONTROL_PING_REQUEST       = 6
+	USER_CONTROL_PING_RESPONSE      = 7
+)
+
+// RTMP_MAX_BUFFER_LENGTHS is how many streams a connection remembers the
+// buffer length of.
+const RTMP_MAX_BUFFER_LENGTHS = 64
+
+// UserControlEvent is the payload of a User Control Message (type 4). Which
+// fields are meaningful depends on EventType: the stream events carry
+// StreamId, SetBufferLength adds BufferLength in milliseconds and the ping
+// events carry TimeStamp.
+type UserControlEvent struct {
+	EventType    uint16
+	StreamId     uint32
+	BufferLength uint32
+	TimeStamp    uint32
+}
+
+// Decode fills e from the body of a user control message. A body too short
+// for its event type is reported with an error wrapping ErrMalformedMessage.
+func (e *UserControlEvent) Decode(b []byte) error {
+	if len(b) < 6 {
+		return fmt.Errorf("%w: user control message too short (%d bytes)", ErrMalformedMessage, len(b))
+	}
+
+	e.EventType = binary.BigEndian.Uint16(b)
+
+	switch e.EventType {
+	case USER_CONTROL_PING_REQUEST, USER_CONTROL_PING_RESPONSE:
+		e.TimeStamp = binary.BigEndian.Uint32(b[2:])
+	case USER_CONTROL_SET_BUFFER_LENGTH:
+		if len(b) < 10 {
+			return fmt.Errorf("%w: set buffer length event too short (%d bytes)", ErrMalformedMessage, len(b))
+		}
+		e.StreamId = binary.BigEndian.Uint32(b[2:])
+		e.BufferLength = binary.BigEndian.Uint32(b[6:])
+	default:
+		e.StreamId = binary.BigEndian.Uint32(b[2:])
+	}
+
+	return nil
+}
+
+func (e *UserControlEvent) Encode() []byte {
+	var eventData []byte
+
+	switch e.EventType {
+	case USER_CONTROL_PING_REQUEST, USER_CONTROL_PING_RESPONSE:
+		eventData = make([]byte, 6)
+		binary.BigEndian.PutUint32(eventData[2:], e.TimeStamp)
+	case USER_CONTROL_SET_BUFFER_LENGTH:
+		eventData = make([]byte, 10)
+		binary.BigEndian.PutUint32(eventData[2:], e.StreamId)
+		binary.BigEndian.PutUint32(eventData[6:], e.BufferLength)
+	default:
+		eventData = make([]byte, 6)
+		binary.BigEndian.PutUint32(eventData[2:], e.StreamId)
+	}
+
+	binary.BigEndian.PutUint16(eventData, e.EventType)
+
+	return eventData
+}